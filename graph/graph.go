@@ -13,11 +13,20 @@ var (
 
 // Connect starts the session with the given database
 func (g *Graph) Open(user, password, dbname, host string) error {
-	var err error
-	g.database, err = pgdoc.OpenDatabase(user, password, dbname, host)
-	g.tables = make(map[string]*pgdoc.Table)
-	g.links = make(map[string]*pgdoc.Link)
-	return err
+	database, err := pgdoc.OpenDatabase(user, password, dbname, host)
+	if err != nil {
+		return err
+	}
+	return g.OpenStore(database)
+}
+
+// OpenStore starts the session using the given store, use it with a
+// pgdoc.MemoryStore to run without a database
+func (g *Graph) OpenStore(store pgdoc.Store) error {
+	g.database = store
+	g.tables = make(map[string]pgdoc.TableStore)
+	g.links = make(map[string]pgdoc.LinkStore)
+	return nil
 }
 
 func (g *Graph) Save(node interface{}) error {
@@ -41,12 +50,12 @@ func (g *Graph) Connect(edge interface{}) error {
 	return err
 }
 
-func (g *Graph) linkForSpec(e interface{}) (*pgdoc.Link, error) {
+func (g *Graph) linkForSpec(e interface{}) (pgdoc.LinkStore, error) {
 	// use the same table
 	if lnk, has := g.links["links"]; has {
 		return lnk, nil
 	}
-	lnk, err := g.database.Link("links")
+	lnk, err := g.database.OpenLink("links")
 	if err != nil {
 		return nil, err
 	}
@@ -54,12 +63,12 @@ func (g *Graph) linkForSpec(e interface{}) (*pgdoc.Link, error) {
 	return lnk, nil
 }
 
-func (g *Graph) tableForSpec(node interface{}) (*pgdoc.Table, error) {
+func (g *Graph) tableForSpec(node interface{}) (pgdoc.TableStore, error) {
 	// use the same table
 	if tbl, has := g.tables["nodes"]; has {
 		return tbl, nil
 	}
-	tbl, err := g.database.Table("nodes")
+	tbl, err := g.database.OpenTable("nodes")
 	if err != nil {
 		return nil, err
 	}
@@ -18,9 +18,9 @@ type (
 		Fields      []FieldDef
 	}
 	Graph struct {
-		database  *pgdoc.Database
-		tables    map[string]*pgdoc.Table
-		links     map[string]*pgdoc.Link
+		database  pgdoc.Store
+		tables    map[string]pgdoc.TableStore
+		links     map[string]pgdoc.LinkStore
 		reflector reflector.R
 	}
 )
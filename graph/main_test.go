@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"amoraes.info/pgdoc"
 	"testing"
 )
 
@@ -45,3 +46,31 @@ func TestSimpleGraph(t *testing.T) {
 		t.Fatalf("error saving access relation: %v", err)
 	}
 }
+
+func TestMemoryGraph(t *testing.T) {
+	g := &Graph{}
+	if err := g.OpenStore(pgdoc.NewMemoryStore()); err != nil {
+		t.Fatalf("error opening graph store: %v", err)
+	}
+	defer g.Close()
+
+	user := User{Email: "bob@email.com"}
+	perm := Permission{Desc: "can start a shell", Cmd: "bash"}
+	if err := g.Save(&user); err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+	if err := g.Save(&perm); err != nil {
+		t.Fatalf("error saving permission: %v", err)
+	}
+	if user.Id == "" || perm.Id == "" {
+		t.Fatalf("nodes should have an id after saving")
+	}
+
+	access := Access{User: user.Id, Permission: perm.Id}
+	if err := g.Connect(&access); err != nil {
+		t.Fatalf("error saving access relation: %v", err)
+	}
+	if access.Id == "" {
+		t.Errorf("edge should have an id after connecting")
+	}
+}
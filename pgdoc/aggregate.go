@@ -0,0 +1,151 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+type (
+	// Aggregation groups the documents of a table and computes
+	// count, sum, avg, min and max for each group. Created by
+	// Table.Aggregate.
+	//
+	// Each result is a json object with one field for each group and
+	// aggregate, named by the as parameter, so results can be scanned
+	// into structs or maps.
+	Aggregation struct {
+		table  *Table
+		query  *Query
+		groups []aggField
+		fields []aggField
+	}
+
+	aggField struct {
+		as   string
+		fn   string
+		path []string
+	}
+)
+
+var (
+	errAggregateWithoutFields = errors.New("aggregation without any aggregate")
+)
+
+// Count return how many documents match the filters of q, nil counts
+// every document.
+func (t *Table) Count(q *Query) (int64, error) {
+	return t.CountContext(context.Background(), q)
+}
+
+func (t *Table) CountContext(ctx context.Context, q *Query) (int64, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "select count(*) from %v where %v", t.name, notExpired)
+	params, err := t.writeWhere(buf, q)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = t.db.QueryRowContext(ctx, string(buf.Bytes()), params...).Scan(&count)
+	return count, err
+}
+
+// Aggregate starts an aggregation over the documents that match the
+// filters of q, nil uses every document. Order and limits of q are
+// ignored.
+func (t *Table) Aggregate(q *Query) *Aggregation {
+	return &Aggregation{table: t, query: q}
+}
+
+// GroupBy adds the value at the given path to the key of the groups,
+// results are sorted by the groups.
+func (a *Aggregation) GroupBy(as string, propPath ...string) *Aggregation {
+	a.groups = append(a.groups, aggField{as, "", propPath})
+	return a
+}
+
+// Count the documents of each group
+func (a *Aggregation) Count(as string) *Aggregation {
+	a.fields = append(a.fields, aggField{as, "count", nil})
+	return a
+}
+
+// Sum the numeric values at the given path
+func (a *Aggregation) Sum(as string, propPath ...string) *Aggregation {
+	a.fields = append(a.fields, aggField{as, "sum", propPath})
+	return a
+}
+
+// Avg of the numeric values at the given path
+func (a *Aggregation) Avg(as string, propPath ...string) *Aggregation {
+	a.fields = append(a.fields, aggField{as, "avg", propPath})
+	return a
+}
+
+// Min of the numeric values at the given path
+func (a *Aggregation) Min(as string, propPath ...string) *Aggregation {
+	a.fields = append(a.fields, aggField{as, "min", propPath})
+	return a
+}
+
+// Max of the numeric values at the given path
+func (a *Aggregation) Max(as string, propPath ...string) *Aggregation {
+	a.fields = append(a.fields, aggField{as, "max", propPath})
+	return a
+}
+
+func (a *Aggregation) Iter() Iterator {
+	return a.IterContext(context.Background())
+}
+
+func (a *Aggregation) IterContext(ctx context.Context) Iterator {
+	if len(a.fields) == 0 {
+		return errIter{errAggregateWithoutFields}
+	}
+	groups := make([]string, len(a.groups))
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "select json_build_object(")
+	for i, g := range a.groups {
+		if len(g.path) == 0 {
+			return errIter{errEmptyPath}
+		}
+		groups[i] = groupPath(g.path)
+		fmt.Fprintf(buf, "%v, %v, ", pq.QuoteLiteral(g.as), groups[i])
+	}
+	for i, f := range a.fields {
+		if i > 0 {
+			fmt.Fprintf(buf, ", ")
+		}
+		if f.fn == "count" {
+			fmt.Fprintf(buf, "%v, count(*)", pq.QuoteLiteral(f.as))
+			continue
+		}
+		if len(f.path) == 0 {
+			return errIter{errEmptyPath}
+		}
+		fmt.Fprintf(buf, "%v, %v(%v)", pq.QuoteLiteral(f.as), f.fn, castPath(f.path, "numeric"))
+	}
+	fmt.Fprintf(buf, ") from %v where %v", a.table.name, notExpired)
+	params, err := a.table.writeWhere(buf, a.query)
+	if err != nil {
+		return errIter{err}
+	}
+	if len(groups) > 0 {
+		fmt.Fprintf(buf, " group by %v order by %v", strings.Join(groups, ", "), strings.Join(groups, ", "))
+	}
+	rows, err := a.table.db.QueryContext(ctx, string(buf.Bytes()), params...)
+	if err != nil {
+		return errIter{err}
+	}
+	return newIterator(rows, a.table.owner)
+}
+
+// groupPath keeps the json type of the value, so groups can be
+// scanned into numbers or booleans. json has no equality, so the
+// value is compared as jsonb.
+func groupPath(propPath []string) string {
+	return fmt.Sprintf("(%v)::jsonb", jsonPath(propPath))
+}
@@ -0,0 +1,236 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+)
+
+type (
+	// RowError is the error found when saving the element at Index
+	RowError struct {
+		Index int
+		Err   error
+	}
+
+	// BulkError is returned by SaveMany and ConnectMany when some
+	// elements couldn't be saved, the other elements are saved anyway.
+	BulkError struct {
+		Rows []RowError
+	}
+
+	bulkRow struct {
+		index int
+		vals  []interface{}
+	}
+)
+
+var (
+	errValNotASlice = errors.New("value isn't a slice")
+)
+
+func (e *BulkError) Error() string {
+	if len(e.Rows) == 1 {
+		return fmt.Sprintf("row %v: %v", e.Rows[0].Index, e.Rows[0].Err)
+	}
+	return fmt.Sprintf("%v rows failed, first error at row %v: %v", len(e.Rows), e.Rows[0].Index, e.Rows[0].Err)
+}
+
+// SaveMany insert all documents from docs (a slice of structs or of
+// pointers to structs) using a single COPY, which is much faster than
+// calling Save for each document.
+//
+// Documents without an Id receive a new one, documents with an Id are
+// inserted with that Id, SaveMany never updates existing documents.
+//
+// If the COPY fails, each document is inserted on its own and the
+// ones that failed are reported through a *BulkError.
+func (t *Table) SaveMany(docs interface{}) error {
+	return t.SaveManyContext(context.Background(), docs)
+}
+
+func (t *Table) SaveManyContext(ctx context.Context, docs interface{}) error {
+	r := &t.owner.reflector
+	vals, ok := r.Elems(docs)
+	if !ok {
+		return errValNotASlice
+	}
+	s, err := t.owner.schemaFor(ctx, t.db, t.name)
+	if err != nil {
+		return err
+	}
+	var failed []RowError
+	rows := make([]bulkRow, 0, len(vals))
+	for i, val := range vals {
+		var id string
+		if r.HasField(val, "Id") {
+			id = r.GetField(val, "Id", "").(string)
+		}
+		if len(id) == 0 {
+			var err error
+			if id, err = t.newId(); err != nil {
+				failed = append(failed, RowError{i, err})
+				continue
+			}
+		}
+		if r.HasField(val, "Id") {
+			r.SetField(val, "Id", id)
+		}
+		r.SetFieldOrTag(val, "Rev", revTag, int64(1))
+		body, err := t.owner.encodeWith(ctx, s, t.name, val)
+		if err != nil {
+			failed = append(failed, RowError{i, err})
+			continue
+		}
+		expires, err := t.expiration(ctx, val)
+		if err != nil {
+			failed = append(failed, RowError{i, err})
+			continue
+		}
+		rows = append(rows, bulkRow{i, []interface{}{id, 1, body, expires}})
+	}
+	return t.owner.bulkInsert(ctx, t.db, t.name, []string{"docid", "rev", "body", "expires_at"}, rows, failed)
+}
+
+// ConnectMany is like Connect but saves all links from edges (a slice
+// of structs or of pointers to structs) using a single COPY.
+//
+// Links that have an Id are inserted with it, the others get a new
+// one. Failures are reported like SaveMany.
+func (l *Link) ConnectMany(edges interface{}) error {
+	return l.ConnectManyContext(context.Background(), edges)
+}
+
+func (l *Link) ConnectManyContext(ctx context.Context, edges interface{}) error {
+	r := &l.owner.reflector
+	vals, ok := r.Elems(edges)
+	if !ok {
+		return errValNotASlice
+	}
+	s, err := l.owner.schemaFor(ctx, l.db, l.name)
+	if err != nil {
+		return err
+	}
+	var failed []RowError
+	rows := make([]bulkRow, 0, len(vals))
+	for i, val := range vals {
+		from, to, label, err := l.endpoints(val)
+		if err != nil {
+			failed = append(failed, RowError{i, err})
+			continue
+		}
+		// like Connect, links that have an id keep it
+		id := r.GetFieldOrTag(val, "Id", `pgdoc:"Id"`, "").(string)
+		if len(id) == 0 {
+			if id, err = l.newId(); err != nil {
+				failed = append(failed, RowError{i, err})
+				continue
+			}
+			r.SetFieldOrTag(val, "Id", `pgdoc:"Id"`, id)
+		}
+		body, err := l.owner.encodeWith(ctx, s, l.name, val)
+		if err != nil {
+			failed = append(failed, RowError{i, err})
+			continue
+		}
+		rows = append(rows, bulkRow{i, []interface{}{id, from, to, label, body}})
+	}
+	err = l.owner.bulkInsert(ctx, l.db, l.name, []string{"linkid", "_from", "_to", "label", "body"}, rows, failed)
+	if be, ok := err.(*BulkError); ok {
+		byIndex := make(map[int]bulkRow, len(rows))
+		for _, row := range rows {
+			byIndex[row.index] = row
+		}
+		for i, re := range be.Rows {
+			if row, has := byIndex[re.Index]; has {
+				from, to, label := row.vals[1].(string), row.vals[2].(string), row.vals[3].(string)
+				be.Rows[i].Err = l.constraintError(danglingError(re.Err, from, to), from, to, label)
+			}
+		}
+	}
+	return err
+}
+
+// bulkInsert copy rows into the table, if the copy fails the rows are
+// inserted one by one, so we can find which ones are broken.
+func (d *Database) bulkInsert(ctx context.Context, db querier, table string, cols []string, rows []bulkRow, failed []RowError) error {
+	err := d.inTransaction(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "savepoint pgdoc_bulk"); err != nil {
+			return err
+		}
+		if err := copyRows(ctx, tx, table, cols, rows); err == nil {
+			_, err = tx.ExecContext(ctx, "release savepoint pgdoc_bulk")
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "rollback to savepoint pgdoc_bulk"); err != nil {
+			return err
+		}
+
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "insert into %v (", table)
+		for i, c := range cols {
+			if i > 0 {
+				fmt.Fprintf(buf, ", ")
+			}
+			fmt.Fprintf(buf, "%v", c)
+		}
+		fmt.Fprintf(buf, ") values (")
+		for i := range cols {
+			if i > 0 {
+				fmt.Fprintf(buf, ", ")
+			}
+			fmt.Fprintf(buf, "$%v", i+1)
+		}
+		fmt.Fprintf(buf, ")")
+		insert := string(buf.Bytes())
+
+		for _, row := range rows {
+			if _, err := tx.ExecContext(ctx, "savepoint pgdoc_row"); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, insert, row.vals...); err != nil {
+				failed = append(failed, RowError{row.index, err})
+				if _, err := tx.ExecContext(ctx, "rollback to savepoint pgdoc_row"); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "release savepoint pgdoc_row"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		sortRowErrors(failed)
+		return &BulkError{failed}
+	}
+	return nil
+}
+
+func copyRows(ctx context.Context, tx *sql.Tx, table string, cols []string, rows []bulkRow) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, cols...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row.vals...); err != nil {
+			return err
+		}
+	}
+	// flush the data
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func sortRowErrors(rows []RowError) {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Index < rows[j].Index })
+}
@@ -0,0 +1,260 @@
+package pgdoc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type (
+	// Collection is a table whose documents are values of T, so
+	// documents are loaded without type assertions. T must be a
+	// struct.
+	//
+	// The top level fields of T can use the pgdoc tag, with a comma
+	// separated list of options:
+	//
+	//	id     the field holds the id of the document instead of Id,
+	//	       must be a string
+	//	index  create an index over the field, see Database.CreateIndexSpec
+	//	unique create an unique index over the field
+	//
+	// Encrypted fields (see Database.SetKeyProvider) can only be
+	// indexed in the deterministic mode.
+	//
+	// Indexes are named after the json name of the field. Numbers,
+	// bools and time.Time are indexed with the matching cast (see
+	// IndexField), so queries comparing them use the index.
+	Collection[T any] struct {
+		table *Table
+		// index of the field tagged with pgdoc:"id", nil uses Id
+		id []int
+	}
+
+	// collectionField is a field of T with pgdoc options
+	collectionField struct {
+		index []int
+		json  string
+		kind  reflect.Kind
+		// cast of the index, see IndexField
+		cast   string
+		id     bool
+		idx    bool
+		unique bool
+	}
+)
+
+var (
+	errCollectionNotStruct = errors.New("collections require a struct type")
+	errIdNotString         = errors.New("the field tagged with pgdoc:\"id\" must be a string")
+	errMultipleIds         = errors.New("only one field can be tagged with pgdoc:\"id\"")
+	errIndexOnEncrypted    = errors.New("indexes over encrypted fields require the deterministic mode")
+)
+
+// NewCollection opens the table name as a collection of T, creating
+// the table and the indexes declared by the tags of T when they
+// don't exist.
+func NewCollection[T any](d *Database, name string) (*Collection[T], error) {
+	return NewCollectionWithOptions[T](d, name, TableOptions{})
+}
+
+func NewCollectionWithOptions[T any](d *Database, name string, opts TableOptions) (*Collection[T], error) {
+	fields, err := collectionFields(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	t, err := d.TableWithOptions(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	c := &Collection[T]{table: t}
+	for _, f := range fields {
+		if f.id {
+			c.id = f.index
+		}
+		if !f.idx && !f.unique {
+			continue
+		}
+		ierr := d.CreateIndexSpec(name, IndexSpec{
+			Name:   identifier(f.json),
+			Fields: []IndexField{{Path: []string{f.json}, Cast: f.cast}},
+			Unique: f.unique,
+		})
+		if ierr != nil && ierr != ErrIndexAlreadyExists {
+			return nil, ierr
+		}
+	}
+	return c, nil
+}
+
+// collectionFields return the fields of tp that have pgdoc options
+func collectionFields(tp reflect.Type) ([]collectionField, error) {
+	if tp.Kind() != reflect.Struct {
+		return nil, errCollectionNotStruct
+	}
+	var out []collectionField
+	hasId := false
+	for i := 0; i < tp.NumField(); i++ {
+		fld := tp.Field(i)
+		tag, ok := fld.Tag.Lookup("pgdoc")
+		if !ok || len(fld.PkgPath) > 0 {
+			continue
+		}
+		cf := collectionField{index: fld.Index, json: fld.Name, kind: fld.Type.Kind()}
+		if name := strings.Split(fld.Tag.Get("json"), ",")[0]; name == "-" {
+			continue
+		} else if len(name) > 0 {
+			cf.json = name
+		}
+		for _, opt := range strings.Split(tag, ",") {
+			switch strings.ToLower(strings.TrimSpace(opt)) {
+			case "id":
+				cf.id = true
+			case "index":
+				cf.idx = true
+			case "unique":
+				cf.unique = true
+			}
+		}
+		// ciphertext is always compared as text
+		if encrypt, deterministic := encryptTag(fld); encrypt && !deterministic && (cf.idx || cf.unique) {
+			return nil, errIndexOnEncrypted
+		} else if !encrypt {
+			cf.cast = fieldCast(fld.Type)
+		}
+		if cf.id {
+			if cf.kind != reflect.String {
+				return nil, errIdNotString
+			}
+			if hasId {
+				return nil, errMultipleIds
+			}
+			hasId = true
+		}
+		if cf.id || cf.idx || cf.unique {
+			out = append(out, cf)
+		}
+	}
+	return out, nil
+}
+
+// fieldCast return the cast used to index the values of tp
+func fieldCast(tp reflect.Type) string {
+	if tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if tp == reflect.TypeOf(time.Time{}) {
+		return "timestamptz"
+	}
+	switch tp.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "numeric"
+	}
+	return ""
+}
+
+// Table return the table used by the collection
+func (c *Collection[T]) Table() *Table {
+	return c.table
+}
+
+func (c *Collection[T]) Name() string {
+	return c.table.name
+}
+
+// Load the document with the given id, sql.ErrNoRows is returned if
+// it doesn't exist
+func (c *Collection[T]) Load(id string) (T, error) {
+	return c.LoadContext(context.Background(), id)
+}
+
+func (c *Collection[T]) LoadContext(ctx context.Context, id string) (T, error) {
+	var out T
+	err := c.table.query(ctx, &out, id)
+	return out, err
+}
+
+// Save works like Table.Save, using the field tagged with pgdoc:"id"
+// as the id when T has one
+func (c *Collection[T]) Save(val *T) (string, error) {
+	return c.SaveContext(context.Background(), val)
+}
+
+func (c *Collection[T]) SaveContext(ctx context.Context, val *T) (string, error) {
+	if c.id == nil {
+		return c.table.SaveContext(ctx, val)
+	}
+	if val == nil {
+		return "", errValNotAPointer
+	}
+	fld := reflect.ValueOf(val).Elem().FieldByIndex(c.id)
+	id := fld.String()
+	if len(id) == 0 {
+		nid, err := c.table.newId()
+		if err != nil {
+			return "", err
+		}
+		// the body carries the id, like the documents with an Id field
+		fld.SetString(nid)
+		if _, err := c.table.insert(ctx, nid, val); err != nil {
+			fld.SetString("")
+			return "", err
+		}
+		return nid, nil
+	}
+	if exists, err := c.table.docExists(ctx, id); err != nil {
+		return "", err
+	} else if !exists {
+		return c.table.insert(ctx, id, val)
+	}
+	return c.table.update(ctx, id, val)
+}
+
+func (c *Collection[T]) Delete(id string) error {
+	return c.table.Delete(id)
+}
+
+func (c *Collection[T]) DeleteContext(ctx context.Context, id string) error {
+	return c.table.DeleteContext(ctx, id)
+}
+
+// Find starts a new query over the documents of the collection, use
+// All or Page to read the results as T.
+func (c *Collection[T]) Find() *Query {
+	return c.table.Find()
+}
+
+// All return every document that match q, nil return every document
+// of the collection
+func (c *Collection[T]) All(q *Query) ([]T, error) {
+	return c.AllContext(context.Background(), q)
+}
+
+func (c *Collection[T]) AllContext(ctx context.Context, q *Query) ([]T, error) {
+	if q == nil {
+		q = c.Find()
+	}
+	var out []T
+	err := q.IterContext(ctx).ScanAll(&out)
+	return out, err
+}
+
+// Page reads a page of the documents that match q, see Query.Page
+func (c *Collection[T]) Page(q *Query, token string, size int) ([]T, string, error) {
+	return c.PageContext(context.Background(), q, token, size)
+}
+
+func (c *Collection[T]) PageContext(ctx context.Context, q *Query, token string, size int) ([]T, string, error) {
+	if q == nil {
+		q = c.Find()
+	}
+	var out []T
+	next, err := q.PageContext(ctx, token, size, &out)
+	return out, next, err
+}
@@ -0,0 +1,54 @@
+package pgdoc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollectionFields(t *testing.T) {
+	type user struct {
+		Key   string `pgdoc:"id"`
+		Email string `json:"email" pgdoc:"unique"`
+		Age   int    `pgdoc:"index"`
+		Rev   int64  `pgdoc:"Rev"`
+		Notes string `json:"-" pgdoc:"index"`
+		Name  string
+		Seen  *time.Time `pgdoc:"index"`
+		Admin bool       `pgdoc:"unique"`
+	}
+	fields, err := collectionFields(reflect.TypeOf(user{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []collectionField{
+		{index: []int{0}, json: "Key", kind: reflect.String, id: true},
+		{index: []int{1}, json: "email", kind: reflect.String, unique: true},
+		{index: []int{2}, json: "Age", kind: reflect.Int, cast: "numeric", idx: true},
+		{index: []int{6}, json: "Seen", kind: reflect.Ptr, cast: "timestamptz", idx: true},
+		{index: []int{7}, json: "Admin", kind: reflect.Bool, cast: "boolean", unique: true},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expecting %v got %v", expected, fields)
+	}
+
+	if _, err := collectionFields(reflect.TypeOf(struct {
+		Key int `pgdoc:"id"`
+	}{})); err != errIdNotString {
+		t.Errorf("expecting %v got %v", errIdNotString, err)
+	}
+	if _, err := collectionFields(reflect.TypeOf(struct {
+		A string `pgdoc:"id"`
+		B string `pgdoc:"id,unique"`
+	}{})); err != errMultipleIds {
+		t.Errorf("expecting %v got %v", errMultipleIds, err)
+	}
+	if _, err := collectionFields(reflect.TypeOf(struct {
+		Email string `pgdoc:"encrypt,unique"`
+	}{})); err != errIndexOnEncrypted {
+		t.Errorf("expecting %v got %v", errIndexOnEncrypted, err)
+	}
+	if _, err := collectionFields(reflect.TypeOf("")); err != errCollectionNotStruct {
+		t.Errorf("expecting %v got %v", errCollectionNotStruct, err)
+	}
+}
@@ -0,0 +1,526 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type (
+	// KeyProvider protects the data key used to encrypt the fields
+	// tagged with pgdoc:"encrypt", usually by calling a key management
+	// service that holds the master key.
+	//
+	// The data key is created by pgdoc and saved in the metadata table
+	// only after being wrapped, so the database alone can't decrypt
+	// the fields.
+	KeyProvider interface {
+		// WrapKey encrypts the data key
+		WrapKey(ctx context.Context, key []byte) ([]byte, error)
+		// UnwrapKey decrypts a data key returned by WrapKey
+		UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+	}
+
+	// fieldCipher encrypts values with AES-GCM using keys derived from
+	// the data key
+	fieldCipher struct {
+		aead cipher.AEAD
+		// key of the HMAC used as nonce by the deterministic mode
+		mac []byte
+	}
+
+	// cryptFn encrypts or decrypts a json value
+	cryptFn func(val interface{}, deterministic bool) (interface{}, error)
+)
+
+const (
+	// tblname and kind of the wrapped data key in the metadata table
+	keyMeta   = "datakey"
+	encPrefix = "pgdoc:enc:1:"
+)
+
+var (
+	// ErrNoKeyProvider is returned when saving or loading values with
+	// fields tagged with pgdoc:"encrypt" without calling SetKeyProvider
+	ErrNoKeyProvider   = errors.New("encrypted fields require a KeyProvider")
+	errInvalidCipher   = errors.New("invalid encrypted value")
+	errDataKeyMismatch = errors.New("the dump uses a different data key than the database")
+
+	// types that have fields tagged with pgdoc:"encrypt"
+	cryptTypes sync.Map
+)
+
+// SetKeyProvider enables the encryption of the fields tagged with
+// pgdoc:"encrypt", the value of the field is encrypted as a whole and
+// stored as a string. Tags are found in nested structs, slices and
+// maps too.
+//
+// By default the ciphertext of a value changes on each save. Fields
+// tagged with pgdoc:"encrypt,deterministic" always have the same
+// ciphertext for the same value, so unique indexes and equality
+// filters still work, see EncryptValue. Deterministic fields reveal
+// which documents have the same value.
+//
+// Only documents saved and loaded as structs are encrypted and
+// decrypted. Dump and queries see the ciphertext, Patch rejects
+// patches that write into encrypted fields and Migrate requires
+// RegisterTypedMigration for documents with encrypted fields.
+func (d *Database) SetKeyProvider(kp KeyProvider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = kp
+	d.cipher = nil
+}
+
+// EncryptValue return the ciphertext of val in deterministic mode, to
+// be used as the value of an Equals filter over a deterministic field
+func (d *Database) EncryptValue(val interface{}) (string, error) {
+	c, err := d.fieldCipher(context.Background())
+	if err != nil {
+		return "", err
+	}
+	out, err := c.encrypt(val, true)
+	if err != nil {
+		return "", err
+	}
+	return out.(string), nil
+}
+
+// fieldCipher return the cipher of the data key, creating the key
+// the first time it is used
+func (d *Database) fieldCipher(ctx context.Context) (*fieldCipher, error) {
+	d.mu.RLock()
+	c, kp := d.cipher, d.keys
+	d.mu.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	if kp == nil {
+		return nil, ErrNoKeyProvider
+	}
+	wrapped, err := d.dataKey(ctx, kp)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kp.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c, err = newFieldCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cipher = c
+	d.mu.Unlock()
+	return c, nil
+}
+
+// dataKey return the wrapped data key. When two processes create the
+// key at the same time only the first one is saved, and both use it.
+func (d *Database) dataKey(ctx context.Context, kp KeyProvider) ([]byte, error) {
+	var wrapped []byte
+	found, err := d.getMeta(ctx, metaTable, keyMeta, &wrapped)
+	if err != nil || found {
+		return wrapped, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err = kp.WrapKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.db.ExecContext(ctx, "insert into "+metaTable+" (tblname, kind, body) values ($1, $2, $3) on conflict (tblname, kind) do nothing",
+		metaTable, keyMeta, jsonCol{wrapped, nil}.plain())
+	if err != nil {
+		return nil, err
+	}
+	if found, err = d.getMeta(ctx, metaTable, keyMeta, &wrapped); err == nil && !found {
+		err = sql.ErrNoRows
+	}
+	return wrapped, err
+}
+
+// restoreDataKey saves the wrapped data key of a dump, the data key
+// of the database can't be replaced since it decrypts the documents
+// already saved.
+func (d *Database) restoreDataKey(ctx context.Context, db querier, wrapped []byte) error {
+	if err := d.ensureMeta(db); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "insert into "+metaTable+" (tblname, kind, body) values ($1, $2, $3) on conflict (tblname, kind) do nothing",
+		metaTable, keyMeta, jsonCol{wrapped, nil}.plain())
+	if err != nil {
+		return err
+	}
+	var current []byte
+	if _, err := d.getMetaOn(ctx, db, metaTable, keyMeta, &current); err != nil {
+		return err
+	}
+	if !bytes.Equal(current, wrapped) {
+		return errDataKeyMismatch
+	}
+	return nil
+}
+
+func newFieldCipher(key []byte) (*fieldCipher, error) {
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("pgdoc encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldCipher{aead, derive("pgdoc deterministic")}, nil
+}
+
+// encrypt return the ciphertext of the json encoding of val. The
+// deterministic mode uses the HMAC of the value as nonce, so the
+// nonce only repeats for the same value.
+func (c *fieldCipher) encrypt(val interface{}, deterministic bool) (interface{}, error) {
+	plain, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if deterministic {
+		h := hmac.New(sha256.New, c.mac)
+		h.Write(plain)
+		copy(nonce, h.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return encPrefix + base64.RawStdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// decrypt reverses encrypt, values that weren't encrypted are kept,
+// so fields can be tagged after documents were saved
+func (c *fieldCipher) decrypt(val interface{}, deterministic bool) (interface{}, error) {
+	str, ok := val.(string)
+	if !ok || !strings.HasPrefix(str, encPrefix) {
+		return val, nil
+	}
+	buf, err := base64.RawStdEncoding.DecodeString(str[len(encPrefix):])
+	if err != nil || len(buf) < c.aead.NonceSize() {
+		return nil, errInvalidCipher
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, buf[:n], buf[n:], nil)
+	if err != nil {
+		return nil, errInvalidCipher
+	}
+	dec := json.NewDecoder(bytes.NewBuffer(plain))
+	dec.UseNumber()
+	var out interface{}
+	err = dec.Decode(&out)
+	return out, err
+}
+
+// decryptAll decrypts every encrypted value found in doc, a decoded
+// json value, whatever the type of the document
+func (c *fieldCipher) decryptAll(doc interface{}) (interface{}, error) {
+	var err error
+	switch v := doc.(type) {
+	case string:
+		return c.decrypt(v, false)
+	case []interface{}:
+		for i := range v {
+			if v[i], err = c.decryptAll(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k := range v {
+			if v[k], err = c.decryptAll(v[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// hasCiphertext return if doc, a decoded json value, has encrypted
+// values
+func hasCiphertext(doc interface{}) bool {
+	switch v := doc.(type) {
+	case string:
+		return strings.HasPrefix(v, encPrefix)
+	case []interface{}:
+		for _, e := range v {
+			if hasCiphertext(e) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			if hasCiphertext(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encrypt return the body with the tagged fields of jc.val encrypted,
+// body must be the json encoding of jc.val
+func (jc jsonCol) encrypt(ctx context.Context, body string) (string, error) {
+	if jc.owner == nil || jc.val == nil || !hasEncrypted(reflect.TypeOf(jc.val)) {
+		return body, nil
+	}
+	c, err := jc.owner.fieldCipher(ctx)
+	if err != nil {
+		return "", err
+	}
+	return cryptBody(reflect.TypeOf(jc.val), []byte(body), c.encrypt)
+}
+
+// decrypt return buf with the tagged fields of jc.val decrypted
+func (jc jsonCol) decrypt(buf []byte) ([]byte, error) {
+	if jc.owner == nil || jc.val == nil || !hasEncrypted(reflect.TypeOf(jc.val)) {
+		return buf, nil
+	}
+	c, err := jc.owner.fieldCipher(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	body, err := cryptBody(reflect.TypeOf(jc.val), buf, c.decrypt)
+	return []byte(body), err
+}
+
+func cryptBody(tp reflect.Type, body []byte, fn cryptFn) (string, error) {
+	dec := json.NewDecoder(bytes.NewBuffer(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", err
+	}
+	doc, err := cryptValue(tp, doc, fn)
+	if err != nil {
+		return "", err
+	}
+	return jsonCol{doc, nil}.plain(), nil
+}
+
+// cryptValue apply fn to the values of the tagged fields found in
+// doc, which is the decoded json of a value of type tp
+func cryptValue(tp reflect.Type, doc interface{}, fn cryptFn) (interface{}, error) {
+	for tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if doc == nil || !hasEncrypted(tp) {
+		return doc, nil
+	}
+	var err error
+	switch tp.Kind() {
+	case reflect.Slice, reflect.Array:
+		list, ok := doc.([]interface{})
+		if !ok {
+			return doc, nil
+		}
+		for i := range list {
+			if list[i], err = cryptValue(tp.Elem(), list[i], fn); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return doc, nil
+		}
+		for k, v := range m {
+			if m[k], err = cryptValue(tp.Elem(), v, fn); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Struct:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return doc, nil
+		}
+		for i := 0; i < tp.NumField(); i++ {
+			fld := tp.Field(i)
+			name, skip := jsonName(fld)
+			if skip {
+				continue
+			}
+			if len(name) == 0 {
+				// fields of embedded structs are promoted
+				if _, err := cryptValue(fld.Type, m, fn); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			v, has := m[name]
+			if !has {
+				continue
+			}
+			if encrypt, deterministic := encryptTag(fld); encrypt {
+				if v != nil {
+					m[name], err = fn(v, deterministic)
+				}
+			} else {
+				m[name], err = cryptValue(fld.Type, v, fn)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// jsonName return the name of fld in the json encoding, empty for
+// embedded structs whose fields are promoted
+func jsonName(fld reflect.StructField) (string, bool) {
+	name := strings.Split(fld.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return "", true
+	}
+	if len(name) > 0 {
+		return name, false
+	}
+	if fld.Anonymous {
+		tp := fld.Type
+		if tp.Kind() == reflect.Ptr {
+			tp = tp.Elem()
+		}
+		if tp.Kind() == reflect.Struct {
+			return "", false
+		}
+	}
+	return fld.Name, len(fld.PkgPath) > 0
+}
+
+// encryptTag return if fld is tagged with pgdoc:"encrypt" and if it
+// uses the deterministic mode
+func encryptTag(fld reflect.StructField) (bool, bool) {
+	var encrypt, deterministic bool
+	for _, opt := range strings.Split(fld.Tag.Get("pgdoc"), ",") {
+		switch strings.ToLower(strings.TrimSpace(opt)) {
+		case "encrypt":
+			encrypt = true
+		case "deterministic":
+			deterministic = true
+		}
+	}
+	return encrypt, deterministic
+}
+
+// hasEncrypted return if values of tp can have encrypted fields
+func hasEncrypted(tp reflect.Type) bool {
+	if has, ok := cryptTypes.Load(tp); ok {
+		return has.(bool)
+	}
+	has := typeHasEncrypted(tp, map[reflect.Type]bool{})
+	cryptTypes.Store(tp, has)
+	return has
+}
+
+// typeHasEncrypted don't cache the types found while visiting tp, the
+// answer for a recursive type is only known after the first visit
+// ends
+func typeHasEncrypted(tp reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[tp] {
+		return false
+	}
+	seen[tp] = true
+	switch tp.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHasEncrypted(tp.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < tp.NumField(); i++ {
+			fld := tp.Field(i)
+			if _, skip := jsonName(fld); skip {
+				continue
+			}
+			if encrypt, _ := encryptTag(fld); encrypt || typeHasEncrypted(fld.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyType return the type of the value at key (an object key or an
+// array index) inside a value of type tp and if it is an encrypted
+// field, ok is false when tp has no such key
+func keyType(tp reflect.Type, key string) (next reflect.Type, encrypted, ok bool) {
+	for tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	switch tp.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return tp.Elem(), false, true
+	case reflect.Struct:
+		fld, found := jsonField(tp, key)
+		if !found {
+			return nil, false, false
+		}
+		encrypted, _ = encryptTag(fld)
+		return fld.Type, encrypted, true
+	}
+	return nil, false, false
+}
+
+// jsonField return the field of tp encoded as name, including the
+// fields promoted from embedded structs. Names are compared like
+// encoding/json does, ignoring the case.
+func jsonField(tp reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < tp.NumField(); i++ {
+		fld := tp.Field(i)
+		fname, skip := jsonName(fld)
+		if skip {
+			continue
+		}
+		if len(fname) == 0 {
+			et := fld.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if f, found := jsonField(et, name); found {
+				return f, true
+			}
+			continue
+		}
+		if strings.EqualFold(fname, name) {
+			return fld, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// encryptedPath return if the value at path inside a value of type tp
+// is, is inside of or contains an encrypted field
+func encryptedPath(tp reflect.Type, path []string) bool {
+	for _, key := range path {
+		next, encrypted, ok := keyType(tp, key)
+		if encrypted {
+			return true
+		}
+		if !ok {
+			return false
+		}
+		tp = next
+	}
+	return hasEncrypted(tp)
+}
@@ -0,0 +1,116 @@
+package pgdoc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCryptBody(t *testing.T) {
+	c, err := newFieldCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("error creating cipher: %v", err)
+	}
+	type contact struct {
+		Phone string `pgdoc:"encrypt"`
+		Kind  string
+	}
+	type person struct {
+		Name     string
+		Email    string `json:"email" pgdoc:"encrypt,deterministic"`
+		Contacts []contact
+		Friends  []*person
+	}
+	val := &person{
+		Name:     "Bob",
+		Email:    "bob@example.com",
+		Contacts: []contact{{"555-1234", "home"}},
+		Friends:  []*person{{Name: "Ann", Email: "ann@example.com"}},
+	}
+	if !hasEncrypted(reflect.TypeOf(val)) || hasEncrypted(reflect.TypeOf(struct{ Name string }{})) {
+		t.Errorf("hasEncrypted should only find tagged fields")
+	}
+
+	plain := jsonCol{val, nil}.plain()
+	body, err := cryptBody(reflect.TypeOf(val), []byte(plain), c.encrypt)
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+	for _, secret := range []string{"bob@example.com", "555-1234", "ann@example.com"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("%v found in %v", secret, body)
+		}
+	}
+	if !strings.Contains(body, "Bob") || !strings.Contains(body, "home") {
+		t.Errorf("fields without tags should not be encrypted: %v", body)
+	}
+	again, _ := cryptBody(reflect.TypeOf(val), []byte(plain), c.encrypt)
+	if again == body {
+		t.Errorf("random mode should change the ciphertext")
+	}
+
+	decrypted, err := cryptBody(reflect.TypeOf(val), []byte(body), c.decrypt)
+	if err != nil {
+		t.Fatalf("error decrypting: %v", err)
+	}
+	var out person
+	if err := (jsonCol{&out, nil}).Scan(decrypted); err != nil {
+		t.Fatalf("error decoding: %v", err)
+	}
+	if !reflect.DeepEqual(&out, val) {
+		t.Errorf("expecting %v got %v", val, out)
+	}
+
+	first, _ := c.encrypt("bob@example.com", true)
+	second, _ := c.encrypt("bob@example.com", true)
+	if first != second {
+		t.Errorf("deterministic mode should keep the ciphertext, got %v and %v", first, second)
+	}
+	if _, err := c.decrypt(encPrefix+"AAAA", false); err != errInvalidCipher {
+		t.Errorf("expecting %v got %v", errInvalidCipher, err)
+	}
+	if v, err := c.decrypt("plain", false); v != "plain" || err != nil {
+		t.Errorf("values without encryption should be kept, got %v: %v", v, err)
+	}
+}
+
+func TestCheckPatch(t *testing.T) {
+	type contact struct {
+		Phone string `pgdoc:"encrypt"`
+		Kind  string
+	}
+	type person struct {
+		Name     string
+		Email    string `json:"email" pgdoc:"encrypt"`
+		Contacts []contact
+		Tags     map[string]string
+	}
+	tp := reflect.TypeOf(&person{})
+	for _, c := range []struct {
+		patch     string
+		encrypted bool
+	}{
+		{`{"Name": "Bob"}`, false},
+		{`{"email": "bob@example.com"}`, true},
+		{`{"Email": "bob@example.com"}`, true},
+		{`{"email": null}`, false},
+		{`{"Contacts": [{"Phone": "555-1234"}]}`, true},
+		{`{"Contacts": null, "Tags": {"a": "b"}}`, false},
+		{`"replaces everything"`, true},
+		{`[{"op": "replace", "path": "/Name", "value": "Bob"}]`, false},
+		{`[{"op": "add", "path": "/Contacts/-", "value": {"Kind": "home"}}]`, true},
+		{`[{"op": "replace", "path": "/Contacts/0/Kind", "value": "home"}]`, false},
+		{`[{"op": "replace", "path": "/Contacts/0/Phone", "value": "555"}]`, true},
+		{`[{"op": "copy", "from": "/email", "path": "/Name"}]`, true},
+		{`[{"op": "remove", "path": "/email"}]`, false},
+		{`[{"op": "replace", "path": "", "value": {}}]`, true},
+	} {
+		err := checkPatch(tp, c.patch)
+		if c.encrypted && err != errPatchEncrypted {
+			t.Errorf("%v: expecting %v got %v", c.patch, errPatchEncrypted, err)
+		} else if !c.encrypted && err != nil {
+			t.Errorf("%v: unexpected error %v", c.patch, err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"strings"
+	"time"
+)
+
+type (
+	// dumpRecord is one line of the stream written by Dump
+	dumpRecord struct {
+		// one of the dump* constants
+		Kind string `json:"kind"`
+		// table or link
+		Name    string        `json:"name"`
+		Options *TableOptions `json:"options,omitempty"`
+		// index name and the sql used to create it
+		Index string `json:"index,omitempty"`
+		Def   string `json:"def,omitempty"`
+		// rows
+		Id  string `json:"id,omitempty"`
+		Rev int64  `json:"rev,omitempty"`
+		// nil for the endpoints nullified by a bound link, the
+		// bound tables for bindings
+		From     *string         `json:"from,omitempty"`
+		To       *string         `json:"to,omitempty"`
+		OnDelete OnDelete        `json:"on_delete,omitempty"`
+		Label    string          `json:"label,omitempty"`
+		Body     json.RawMessage `json:"body,omitempty"`
+		// only for documents that expire
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+)
+
+const (
+	dumpTable  = "table"
+	dumpLink   = "link"
+	dumpIndex  = "index"
+	dumpSchema = schemaMeta
+	dumpText   = textMeta
+	dumpDoc    = "doc"
+	dumpEdge   = "edge"
+	dumpBind   = "bind"
+	dumpKey    = keyMeta
+)
+
+var (
+	errUnknownRelation = errors.New("relation isn't a pgdoc table or link")
+)
+
+// Dump writes the given tables and links to w as JSON Lines, each
+// table is described by its options, indexes and schema followed by
+// its rows, links also by the tables they are bound to. If no names are given every table and link is written.
+//
+// The wrapped data key (see SetKeyProvider) is written first, so
+// encrypted fields can be read after a restore with the same
+// KeyProvider.
+//
+// Everything is read in a single read only transaction, so the
+// output is a consistent snapshot even if the database is written
+// while it runs.
+//
+// The output can be loaded by Restore.
+func (d *Database) Dump(w io.Writer, names ...string) error {
+	return d.DumpContext(context.Background(), w, names...)
+}
+
+func (d *Database) DumpContext(ctx context.Context, w io.Writer, names ...string) error {
+	// the metadata table can't be created by a read only transaction
+	if err := d.ensureMeta(d.db); err != nil {
+		return err
+	}
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	return doInsideTransaction(tx, func(tx *sql.Tx) error {
+		if len(names) == 0 {
+			var err error
+			if names, err = d.relations(ctx, tx); err != nil {
+				return err
+			}
+		}
+		enc := json.NewEncoder(w)
+		var key json.RawMessage
+		if has, err := d.getMetaOn(ctx, tx, metaTable, keyMeta, &key); err != nil {
+			return err
+		} else if has {
+			if err := enc.Encode(dumpRecord{Kind: dumpKey, Body: key}); err != nil {
+				return err
+			}
+		}
+		for _, name := range names {
+			if err := d.dump(ctx, tx, enc, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// relations return the name of every table and link
+func (d *Database) relations(ctx context.Context, db querier) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `select table_name from information_schema.columns
+		where table_schema = current_schema() and column_name in ('docid', 'linkid')
+		except select table_name from information_schema.columns
+		where table_schema = current_schema() and column_name = 'seq'
+		order by 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (d *Database) dump(ctx context.Context, db querier, enc *json.Encoder, name string) error {
+	cols, err := (&tableDef{name: name}).columns(db)
+	if err != nil {
+		return err
+	}
+	kind := dumpTable
+	if _, isLink := cols["linkid"]; isLink {
+		kind = dumpLink
+	} else if _, isTable := cols["docid"]; !isTable {
+		return fmt.Errorf("%v: %v", errUnknownRelation, name)
+	}
+
+	opts := &TableOptions{JSONB: cols["body"].kind == "jsonb"}
+	if kind == dumpTable {
+		if opts.History, err = historyDef(name).exists(db); err != nil {
+			return err
+		}
+		if _, err = d.getMetaOn(ctx, db, name, ttlMeta, &opts.TTL); err != nil {
+			return err
+		}
+	}
+	if err := enc.Encode(dumpRecord{Kind: kind, Name: name, Options: opts}); err != nil {
+		return err
+	}
+	if kind == dumpLink {
+		rec := dumpRecord{Kind: dumpBind, Name: name}
+		if rec.From, rec.To, rec.OnDelete, err = binding(ctx, db, name); err != nil {
+			return err
+		}
+		if rec.From != nil || rec.To != nil {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the indexes created by Constrain only have a common prefix
+	rows, err := db.QueryContext(ctx, "select indexname, indexdef from pg_indexes where tablename = $1 and (indexname like $2 or indexname like $3) order by indexname",
+		name, "idx\\_"+name+"\\_%", strings.Replace(multiplicityIndex, "_", "\\_", -1)+"%")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec := dumpRecord{Kind: dumpIndex, Name: name}
+		if err := rows.Scan(&rec.Index, &rec.Def); err != nil {
+			return err
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, kind := range []string{dumpSchema, dumpText} {
+		var meta json.RawMessage
+		if has, err := d.getMetaOn(ctx, db, name, kind, &meta); err != nil {
+			return err
+		} else if has {
+			if err := enc.Encode(dumpRecord{Kind: kind, Name: name, Body: meta}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if kind == dumpLink {
+		rows, err = db.QueryContext(ctx, fmt.Sprintf("select linkid, _from, _to, label, body from %v order by linkid", name))
+	} else {
+		rows, err = db.QueryContext(ctx, fmt.Sprintf("select docid, rev, body, expires_at from %v order by docid", name))
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var body []byte
+		if kind == dumpLink {
+			rec := dumpRecord{Kind: dumpEdge, Name: name}
+			var from, to sql.NullString
+			err = rows.Scan(&rec.Id, &from, &to, &rec.Label, &body)
+			if err == nil {
+				if from.Valid {
+					rec.From = &from.String
+				}
+				if to.Valid {
+					rec.To = &to.String
+				}
+				rec.Body = json.RawMessage(body)
+				err = enc.Encode(rec)
+			}
+		} else {
+			rec := dumpRecord{Kind: dumpDoc, Name: name}
+			var expires pq.NullTime
+			err = rows.Scan(&rec.Id, &rec.Rev, &body, &expires)
+			if err == nil {
+				rec.Body = json.RawMessage(body)
+				if expires.Valid {
+					rec.ExpiresAt = &expires.Time
+				}
+				err = enc.Encode(rec)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Restore loads the output of Dump, tables and links are created if
+// needed and the rows replace the ones with the same id.
+//
+// Tables, indexes and rows are restored in a single transaction,
+// schemas and text index definitions are registered after it
+// commits. Documents aren't validated against the schemas. Links
+// are bound (see Link.Bind) after every row is restored.
+//
+// The data key of the dump is saved if the database doesn't have
+// one, Restore fails if the database has a different key.
+func (d *Database) Restore(r io.Reader) error {
+	return d.RestoreContext(context.Background(), r)
+}
+
+func (d *Database) RestoreContext(ctx context.Context, r io.Reader) error {
+	var meta []*dumpRecord
+	err := d.TransactionContext(ctx, func(tx *Tx) error {
+		var binds []*dumpRecord
+		dec := json.NewDecoder(r)
+		for {
+			var rec dumpRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := d.restore(ctx, tx, &rec); err != nil {
+				return err
+			}
+			switch rec.Kind {
+			case dumpSchema, dumpText:
+				meta = append(meta, &rec)
+			case dumpBind:
+				binds = append(binds, &rec)
+			}
+		}
+		// the bound tables may come after the link in the dump
+		for _, rec := range binds {
+			if err := bind(ctx, tx.tx, rec.Name, rec.From, rec.To, rec.OnDelete); err != nil {
+				return danglingError(err, "", "")
+			}
+		}
+		return nil
+	})
+	// the restored tables may have other schemas than the cached ones
+	d.forgetSchemas()
+	if err != nil {
+		return err
+	}
+	for _, rec := range meta {
+		if rec.Kind == dumpSchema {
+			err = d.SetSchema(rec.Name, rec.Body)
+		} else {
+			err = d.setMeta(rec.Name, rec.Kind, rec.Body)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) restore(ctx context.Context, tx *Tx, rec *dumpRecord) error {
+	var opts TableOptions
+	if rec.Options != nil {
+		opts = *rec.Options
+	}
+	var err error
+	switch rec.Kind {
+	case dumpTable:
+		_, err = tx.TableWithOptions(rec.Name, opts)
+	case dumpLink:
+		_, err = tx.LinkWithOptions(rec.Name, opts)
+	case dumpIndex:
+		var exists bool
+		err = tx.tx.QueryRowContext(ctx, "select true from pg_indexes where tablename = $1 and indexname = $2", rec.Name, rec.Index).Scan(&exists)
+		if err == sql.ErrNoRows {
+			_, err = tx.tx.ExecContext(ctx, rec.Def)
+		}
+	case dumpSchema:
+		_, err = ParseSchema(rec.Body)
+	case dumpText:
+		err = json.Unmarshal(rec.Body, &map[string]textIndex{})
+	case dumpKey:
+		var wrapped []byte
+		if err = json.Unmarshal(rec.Body, &wrapped); err == nil {
+			err = d.restoreDataKey(ctx, tx.tx, wrapped)
+		}
+	case dumpBind:
+		// the rows may have null endpoints, the constraints are
+		// created by RestoreContext
+		if rec.OnDelete == Nullify {
+			for col, table := range map[string]*string{"_from": rec.From, "_to": rec.To} {
+				if table != nil && err == nil {
+					_, err = tx.tx.ExecContext(ctx, fmt.Sprintf("alter table %v alter column %v drop not null", rec.Name, col))
+				}
+			}
+		}
+	case dumpDoc:
+		_, err = tx.tx.ExecContext(ctx, fmt.Sprintf("insert into %v (docid, rev, body, expires_at) values ($1, $2, $3, $4) on conflict (docid) do update set rev = excluded.rev, body = excluded.body, expires_at = excluded.expires_at", rec.Name),
+			rec.Id, rec.Rev, string(rec.Body), rec.ExpiresAt)
+		// tables without a TTL must be registered for Reap
+		if err == nil && rec.ExpiresAt != nil {
+			err = d.markExpiring(ctx, tx.tx, rec.Name)
+		}
+	case dumpEdge:
+		_, err = tx.tx.ExecContext(ctx, fmt.Sprintf("insert into %v (linkid, _from, _to, label, body) values ($1, $2, $3, $4, $5) on conflict (linkid) do update set _from = excluded._from, _to = excluded._to, label = excluded.label, body = excluded.body", rec.Name),
+			rec.Id, rec.From, rec.To, rec.Label, string(rec.Body))
+	default:
+		err = fmt.Errorf("invalid record kind %q in dump", rec.Kind)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	errNoHistory = errors.New("table was not created with the History option")
+)
+
+const (
+	historyFunction = `create or replace function pgdoc_history() returns trigger as $$
+begin
+	if TG_OP = 'DELETE' then
+		execute format('insert into %I (docid, rev, op) values ($1, $2, $3)', TG_ARGV[0]) using OLD.docid, OLD.rev, TG_OP;
+	else
+		execute format('insert into %I (docid, rev, op, body) values ($1, $2, $3, $4)', TG_ARGV[0]) using NEW.docid, NEW.rev, TG_OP, NEW.body::json;
+	end if;
+	return null;
+end;
+$$ language plpgsql`
+)
+
+func historyDef(table string) *tableDef {
+	return &tableDef{
+		name: table + "_history",
+		def: []columnDef{
+			columnDef{
+				name:    "seq",
+				kind:    "bigserial",
+				notnull: "not null",
+				pk:      true,
+			},
+			columnDef{
+				name:    "docid",
+				kind:    "varchar(100)",
+				notnull: "not null",
+				idx:     "btree",
+			},
+			columnDef{
+				name:    "rev",
+				kind:    "bigint",
+				notnull: "not null",
+			},
+			columnDef{
+				name:    "op",
+				kind:    "varchar(10)",
+				notnull: "not null",
+			},
+			columnDef{
+				name:    "changed_at",
+				kind:    "timestamptz",
+				notnull: "not null default clock_timestamp()",
+			},
+			columnDef{
+				name: "body",
+				kind: "json",
+			},
+		},
+	}
+}
+
+// ensureHistory creates the history table and the trigger that
+// fills it
+func (d *Database) ensureHistory(db querier, table string) error {
+	def := historyDef(table)
+	if err := d.ensure(db, def); err != nil {
+		return err
+	}
+	if exists, err := triggerExists(db, "trg_"+table+"_history"); err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(historyFunction); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("create trigger trg_%v_history after insert or update or delete on %v for each row execute procedure pgdoc_history(%v)",
+		table, table, pq.QuoteLiteral(def.name)))
+	return err
+}
+
+// History return every saved version of the document, from the
+// oldest to the newest. Deletions aren't included.
+func (t *Table) History(id string) Iterator {
+	return t.HistoryContext(context.Background(), id)
+}
+
+func (t *Table) HistoryContext(ctx context.Context, id string) Iterator {
+	if !t.history {
+		return errIter{errNoHistory}
+	}
+	rows, err := t.db.QueryContext(ctx, fmt.Sprintf("select body from %v_history where docid = $1 and body is not null order by seq", t.name), id)
+	if err != nil {
+		return errIter{err}
+	}
+	return newIterator(rows, t.owner)
+}
+
+// LoadAt is like Load but returns the document as it was at the given
+// time. If the document didn't exist (or was deleted) at that time,
+// sql.ErrNoRows is returned.
+func (t *Table) LoadAt(out interface{}, id string, at time.Time) error {
+	return t.LoadAtContext(context.Background(), out, id, at)
+}
+
+func (t *Table) LoadAtContext(ctx context.Context, out interface{}, id string, at time.Time) error {
+	if !t.owner.reflector.IsPtr(out) {
+		return errValNotAPointer
+	}
+	if !t.history {
+		return errNoHistory
+	}
+	var rev int64
+	var body []byte
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("select rev, body from %v_history where docid = $1 and changed_at <= $2 order by seq desc limit 1", t.name), id, at).Scan(&rev, &body)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return sql.ErrNoRows
+	}
+	if err := (jsonCol{out, t.owner}).Scan(body); err != nil {
+		return err
+	}
+	t.owner.reflector.SetFieldOrTag(out, "Rev", revTag, rev)
+	return nil
+}
@@ -0,0 +1,179 @@
+package pgdoc
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+type (
+	// IDGenerator creates the ids of new documents and links
+	IDGenerator interface {
+		// NewID return a new unique id, prefix is the name of the
+		// table or link where the id will be used.
+		//
+		// Ids MUST NOT be longer than 100 characters.
+		NewID(prefix string) (string, error)
+	}
+
+	// UUIDGenerator generates random UUIDs and ignores the prefix,
+	// wrap it with PrefixedGenerator to add it. Databases created
+	// before the generators existed used it.
+	UUIDGenerator struct{}
+
+	// ULIDGenerator generates ULIDs (https://github.com/ulid/spec),
+	// ids generated later are sorted after the older ones, which
+	// keeps B-tree indexes compact. The prefix is ignored, so the ids
+	// can be wrapped by PrefixedGenerator.
+	//
+	// Ids generated in the same millisecond are monotonic.
+	ULIDGenerator struct {
+		mu      sync.Mutex
+		lastMs  uint64
+		lastRnd [10]byte
+	}
+
+	// PrefixedGenerator adds the prefix (and Separator) in front of
+	// the ids created by Gen, producing ids like users_01ARZ3NDEKTSV4RRFFQ69G5FAV.
+	//
+	// A nil Gen means a ULIDGenerator and an empty Separator means "_".
+	// A PrefixedGenerator with the defaults is the default generator.
+	PrefixedGenerator struct {
+		Gen       IDGenerator
+		Separator string
+
+		once sync.Once
+	}
+
+	// SequenceGenerator uses one database sequence per prefix
+	// (pgdoc_<prefix>_seq), producing numeric ids. Prefixes too long
+	// for a sequence name use a hash of the prefix instead.
+	SequenceGenerator struct {
+		owner *Database
+
+		mu      sync.Mutex
+		created map[string]bool
+	}
+)
+
+const (
+	crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// postgresql truncates longer identifiers
+	maxIdentifier = 63
+)
+
+var (
+	// used when SetIDGenerator isn't called, shared so ids created in
+	// the same millisecond are still sorted
+	defaultIds IDGenerator = &PrefixedGenerator{}
+)
+
+func (UUIDGenerator) NewID(prefix string) (string, error) {
+	return uuid.New(), nil
+}
+
+func (g *ULIDGenerator) NewID(prefix string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= g.lastMs {
+		// same millisecond (or the clock went back), just increment
+		// the random part so ids are still sorted
+		ms = g.lastMs
+		i := len(g.lastRnd) - 1
+		for ; i >= 0; i-- {
+			g.lastRnd[i]++
+			if g.lastRnd[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			return "", fmt.Errorf("ulid overflow at %v", ms)
+		}
+	} else {
+		if _, err := rand.Read(g.lastRnd[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(id[6:], g.lastRnd[:])
+	return encodeULID(id), nil
+}
+
+// encodeULID writes the 128 bits as 26 base32 characters, the two
+// most significant bits of the first character are always zero
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	var acc uint32
+	bits := uint(2)
+	pos := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out)
+}
+
+func (g *PrefixedGenerator) NewID(prefix string) (string, error) {
+	g.once.Do(func() {
+		if g.Gen == nil {
+			g.Gen = &ULIDGenerator{}
+		}
+		if len(g.Separator) == 0 {
+			g.Separator = "_"
+		}
+	})
+	id, err := g.Gen.NewID(prefix)
+	if err != nil {
+		return "", err
+	}
+	return prefix + g.Separator + id, nil
+}
+
+// NewSequenceGenerator return a generator that uses sequences
+// created on d
+func NewSequenceGenerator(d *Database) *SequenceGenerator {
+	return &SequenceGenerator{owner: d, created: make(map[string]bool)}
+}
+
+func (g *SequenceGenerator) NewID(prefix string) (string, error) {
+	seq := sequenceName(prefix)
+	g.mu.Lock()
+	created := g.created[seq]
+	g.mu.Unlock()
+	if !created {
+		if _, err := g.owner.db.Exec(fmt.Sprintf("create sequence if not exists %v", pq.QuoteIdentifier(seq))); err != nil {
+			return "", err
+		}
+		g.mu.Lock()
+		g.created[seq] = true
+		g.mu.Unlock()
+	}
+	var id int64
+	err := g.owner.db.QueryRow("select nextval($1)", pq.QuoteIdentifier(seq)).Scan(&id)
+	return fmt.Sprintf("%d", id), err
+}
+
+// sequenceName return the name of the sequence used for prefix, long
+// prefixes are hashed so they don't share a truncated name
+func sequenceName(prefix string) string {
+	seq := fmt.Sprintf("pgdoc_%v_seq", prefix)
+	if len(seq) <= maxIdentifier {
+		return seq
+	}
+	sum := sha256.Sum256([]byte(prefix))
+	return fmt.Sprintf("pgdoc_%x_seq", sum[:16])
+}
@@ -0,0 +1,78 @@
+package pgdoc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestULIDGenerator(t *testing.T) {
+	g := &ULIDGenerator{}
+	prev := ""
+	for i := 0; i < 1000; i++ {
+		id, err := g.NewID("docs")
+		if err != nil {
+			t.Fatalf("error generating id: %v", err)
+		}
+		if len(id) != 26 {
+			t.Fatalf("ulid should have 26 characters got %v", id)
+		}
+		if id <= prev {
+			t.Fatalf("ids should be sorted, %v came after %v", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestEncodeULID(t *testing.T) {
+	var id [16]byte
+	if out := encodeULID(id); out != strings.Repeat("0", 26) {
+		t.Errorf("expecting only zeros got %v", out)
+	}
+	for i := range id {
+		id[i] = 0xff
+	}
+	if out := encodeULID(id); out != "7"+strings.Repeat("Z", 25) {
+		t.Errorf("expecting the max ulid got %v", out)
+	}
+}
+
+func TestPrefixedGenerator(t *testing.T) {
+	g := &PrefixedGenerator{}
+	id, err := g.NewID("users")
+	if err != nil {
+		t.Fatalf("error generating id: %v", err)
+	}
+	if !strings.HasPrefix(id, "users_") || len(id) != len("users_")+26 {
+		t.Errorf("expecting a prefixed ulid got %v", id)
+	}
+}
+
+func TestDefaultGenerator(t *testing.T) {
+	id, err := WrapDB(nil).newId("users")
+	if err != nil {
+		t.Fatalf("error generating id: %v", err)
+	}
+	if !strings.HasPrefix(id, "users_") || len(id) != len("users_")+26 {
+		t.Errorf("expecting a prefixed ulid got %v", id)
+	}
+	uuid, err := UUIDGenerator{}.NewID("users")
+	if err != nil || strings.HasPrefix(uuid, "users") {
+		t.Errorf("expecting an uuid without prefix got %v: %v", uuid, err)
+	}
+}
+
+func TestSequenceName(t *testing.T) {
+	if seq := sequenceName("docs"); seq != "pgdoc_docs_seq" {
+		t.Errorf("short prefixes should be kept got %v", seq)
+	}
+	a := sequenceName(strings.Repeat("a", 60) + "_first")
+	b := sequenceName(strings.Repeat("a", 60) + "_second")
+	if a == b {
+		t.Errorf("long prefixes should have different names got %v", a)
+	}
+	for _, seq := range []string{a, b} {
+		if len(seq) > maxIdentifier {
+			t.Errorf("%v is longer than %v bytes", seq, maxIdentifier)
+		}
+	}
+}
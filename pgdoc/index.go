@@ -0,0 +1,259 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// IndexField is one of the expressions of an index
+	IndexField struct {
+		Path []string
+		// Type used to compare the values, one of "" (text),
+		// "numeric", "timestamptz" or "boolean". Queries use the same
+		// cast when the filter value is a number, a time.Time or a
+		// bool, so they can use the index.
+		Cast string
+	}
+
+	// IndexSpec describes an index created by CreateIndexSpec
+	IndexSpec struct {
+		Name   string
+		Fields []IndexField
+		Unique bool
+		// Only documents that match every filter are indexed, values
+		// are written as literals in the index definition.
+		//
+		// Queries send their values as parameters, so postgresql can
+		// only prove that they match the predicate when it plans the
+		// query with the values. Partial indexes are used by queries
+		// planned like that or written by hand with literals, not by
+		// prepared statements with a generic plan.
+		Where []Filter
+		// Build the index without locking writes to the table, can't
+		// be used inside a transaction. If it fails the index is left
+		// invalid and must be dropped.
+		Concurrently bool
+	}
+
+	// IndexInfo describes an index found by Indexes
+	IndexInfo struct {
+		// Name without the idx_<table>_ prefix used by pgdoc, indexes
+		// created by someone else keep their name
+		Name   string
+		Unique bool
+		// false if a concurrent creation failed
+		Valid bool
+		// sql used to create the index
+		Def string
+	}
+)
+
+const (
+	// text to timestamptz is only stable, because it depends on the
+	// timezone and the date style of the session. Both are fixed for
+	// the function, so timestamps without an offset are always read
+	// as UTC and the function can be immutable.
+	tsFunction = `create or replace function pgdoc_ts(text) returns timestamptz as $$
+	select $1::timestamptz
+$$ language sql immutable set timezone = 'UTC' set datestyle = 'ISO, YMD'`
+
+	// the function exists with the current definition
+	tsExists = `select exists(select 1 from pg_proc p where p.proname = 'pgdoc_ts'
+		and p.pronamespace = (select oid from pg_namespace where nspname = current_schema())
+		and exists(select 1 from unnest(p.proconfig) c where lower(c) = 'timezone=utc'))`
+)
+
+var (
+	errIndexWithoutName  = errors.New("index without a name")
+	errInvalidCast       = errors.New("index cast must be one of numeric, timestamptz or boolean")
+	errSpecWithoutFields = errors.New("partial and concurrent indexes require at least one field")
+)
+
+// CreateIndexSpec creates the index described by spec, fields are
+// indexed in the given order. A spec without fields creates a GIN
+// index over the whole body.
+func (d *Database) CreateIndexSpec(tableOrLink string, spec IndexSpec) error {
+	if len(spec.Name) == 0 {
+		return errIndexWithoutName
+	}
+	if exists, err := d.indexExistsOn(tableOrLink, spec.Name); err != nil {
+		return err
+	} else if exists {
+		return ErrIndexAlreadyExists
+	}
+	if len(spec.Fields) == 0 {
+		if len(spec.Where) > 0 || spec.Concurrently {
+			return errSpecWithoutFields
+		}
+		return d.createGINIndex(tableOrLink, spec.Name, spec.Unique)
+	}
+	if err := d.installTimestamp(d.db); err != nil {
+		return err
+	}
+	cmd, err := spec.sql(tableOrLink)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(cmd)
+	return err
+}
+
+func (spec *IndexSpec) sql(table string) (string, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "CREATE ")
+	if spec.Unique {
+		fmt.Fprintf(buf, "UNIQUE ")
+	}
+	fmt.Fprintf(buf, "INDEX ")
+	if spec.Concurrently {
+		fmt.Fprintf(buf, "CONCURRENTLY ")
+	}
+	fmt.Fprintf(buf, "idx_%v_%v on %v (", table, spec.Name, table)
+	for i, f := range spec.Fields {
+		if len(f.Path) == 0 {
+			return "", errEmptyPath
+		}
+		switch f.Cast {
+		case "", "numeric", "timestamptz", "boolean":
+		default:
+			return "", errInvalidCast
+		}
+		if i > 0 {
+			fmt.Fprintf(buf, ", ")
+		}
+		fmt.Fprintf(buf, "(%v)", castPath(f.Path, f.Cast))
+	}
+	fmt.Fprintf(buf, ")")
+	if len(spec.Where) > 0 {
+		where := &bytes.Buffer{}
+		params, err := (&Query{filter: spec.Where}).writeFilter(where, nil)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, " where %v", inlineParams(string(where.Bytes()), params))
+	}
+	return string(buf.Bytes()), nil
+}
+
+// inlineParams replace the placeholders of query with the quoted
+// values, used where postgresql don't accept parameters.
+//
+// Placeholders are read with every digit, so $1 isn't the prefix of
+// $10, and a $ inside a quoted literal or identifier is kept.
+func inlineParams(query string, params []interface{}) string {
+	out := &bytes.Buffer{}
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			// doubled quotes don't end the literal, and are copied
+			// by the next iteration
+			if c == quote && (i+1 == len(query) || query[i+1] != quote) {
+				quote = 0
+			} else if c == quote {
+				out.WriteByte(c)
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			end := i + 1
+			for end < len(query) && query[end] >= '0' && query[end] <= '9' {
+				end++
+			}
+			n, err := strconv.Atoi(query[i+1 : end])
+			if err != nil || n < 1 || n > len(params) {
+				break
+			}
+			out.WriteString(paramLiteral(params[n-1]))
+			i = end - 1
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return string(out.Bytes())
+}
+
+// paramLiteral return val as a quoted literal, times use the format
+// read by pgdoc_ts
+func paramLiteral(val interface{}) string {
+	var lit string
+	switch v := val.(type) {
+	case time.Time:
+		lit = v.Format(time.RFC3339Nano)
+	default:
+		lit = fmt.Sprintf("%v", v)
+	}
+	return pq.QuoteLiteral(lit)
+}
+
+// Indexes return the indexes of the given table or link, including
+// the ones created by pgdoc for its own columns.
+func (d *Database) Indexes(tableOrLink string) ([]IndexInfo, error) {
+	rows, err := d.db.Query(`select c.relname, x.indisunique, x.indisvalid, pg_get_indexdef(x.indexrelid)
+		from pg_index x join pg_class c on c.oid = x.indexrelid join pg_class t on t.oid = x.indrelid
+		where t.relname = $1 and pg_table_is_visible(t.oid) order by c.relname`, tableOrLink)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prefix := fmt.Sprintf("idx_%v_", tableOrLink)
+	var out []IndexInfo
+	for rows.Next() {
+		var info IndexInfo
+		if err := rows.Scan(&info.Name, &info.Unique, &info.Valid, &info.Def); err != nil {
+			return nil, err
+		}
+		info.Name = strings.TrimPrefix(info.Name, prefix)
+		out = append(out, info)
+	}
+	return out, rows.Err()
+}
+
+// installTimestamp creates the function used to cast timestamps if
+// it doesn't exist, the first time an index or a query needs it. Like
+// ensureMeta it is only remembered outside of transactions.
+//
+// An advisory lock serializes the processes that create it at the
+// same time, and roles that can't create functions can still use it
+// once it exists.
+func (d *Database) installTimestamp(db querier) error {
+	d.mu.RLock()
+	ready := d.tsReady
+	d.mu.RUnlock()
+	if ready {
+		return nil
+	}
+	err := d.inTransaction(context.Background(), db, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(tsExists).Scan(&exists); err != nil || exists {
+			return err
+		}
+		if _, err := tx.Exec("select pg_advisory_xact_lock(hashtext('pgdoc_ts'))"); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(tsExists).Scan(&exists); err != nil || exists {
+			return err
+		}
+		_, err := tx.Exec(tsFunction)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, inTx := db.(*sql.Tx); !inTx {
+		d.mu.Lock()
+		d.tsReady = true
+		d.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package pgdoc
+
+import (
+	"testing"
+)
+
+func TestInlineParams(t *testing.T) {
+	params := make([]interface{}, 10)
+	for i := range params {
+		params[i] = i + 1
+	}
+	query := `body->>'$1' = $1 and "$2" = $2 and body->>'it''s $3' = $10`
+	expected := `body->>'$1' = '1' and "$2" = '2' and body->>'it''s $3' = '10'`
+	if actual := inlineParams(query, params); actual != expected {
+		t.Errorf("Should inline %v got %v", expected, actual)
+	}
+	if actual := inlineParams("body->>'a' = $11", params); actual != "body->>'a' = $11" {
+		t.Errorf("Should keep unknown placeholders got %v", actual)
+	}
+}
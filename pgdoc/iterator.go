@@ -3,6 +3,7 @@ package pgdoc
 import (
 	"amoraes.info/pgdoc/reflector"
 	"database/sql"
+	"errors"
 )
 
 type (
@@ -32,11 +33,16 @@ type (
 		//
 		// Calls to Close are idempotent
 		Close() error
+		// ScanAll appends every remaining value to the slice pointed
+		// by out and closes the iterator. The slice can hold values
+		// or pointers.
+		ScanAll(out interface{}) error
 	}
 
 	dbRowsIter struct {
 		rows      *sql.Rows
-		reflector reflector.R
+		reflector *reflector.R
+		owner     *Database
 	}
 
 	errIter struct {
@@ -44,10 +50,15 @@ type (
 	}
 )
 
-func newIterator(rows *sql.Rows, r reflector.R) Iterator {
+var (
+	errValNotASlicePtr = errors.New("value isn't a pointer to a slice")
+)
+
+func newIterator(rows *sql.Rows, d *Database) Iterator {
 	return &dbRowsIter{
 		rows,
-		r,
+		&d.reflector,
+		d,
 	}
 }
 
@@ -67,11 +78,32 @@ func (d *dbRowsIter) Scan(out interface{}) error {
 	if !d.reflector.IsPtr(out) {
 		return errValNotAPointer
 	}
-	jc := jsonCol{out}
+	jc := jsonCol{out, d.owner}
 	return d.rows.Scan(&jc)
 }
 
-func (e errIter) Next() bool                 { return false }
-func (e errIter) Err() error                 { return e.err }
-func (e errIter) Close() error               { return nil }
-func (e errIter) Scan(out interface{}) error { return e.err }
+func (d *dbRowsIter) ScanAll(out interface{}) error {
+	return scanAll(d, d.reflector, out)
+}
+
+// scanAll implements ScanAll using Next and Scan
+func scanAll(it Iterator, r *reflector.R, out interface{}) error {
+	defer it.Close()
+	if _, ok := r.NewElem(out); !ok {
+		return errValNotASlicePtr
+	}
+	for it.Next() {
+		elem, _ := r.NewElem(out)
+		if err := it.Scan(elem); err != nil {
+			return err
+		}
+		r.Append(out, elem)
+	}
+	return it.Err()
+}
+
+func (e errIter) Next() bool                    { return false }
+func (e errIter) Err() error                    { return e.err }
+func (e errIter) Close() error                  { return nil }
+func (e errIter) Scan(out interface{}) error    { return e.err }
+func (e errIter) ScanAll(out interface{}) error { return e.err }
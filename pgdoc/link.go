@@ -1,20 +1,30 @@
 package pgdoc
 
 import (
+	"amoraes.info/pgdoc/reflector"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 )
 
+var (
+	errInvalidLink = errors.New("all links MUST HAVE a valid From, To and Label fields")
+)
+
 func (l *Link) Name() string {
 	return l.name
 }
 
 func (l *Link) Load(out interface{}, id string) error {
+	return l.LoadContext(context.Background(), out, id)
+}
+
+func (l *Link) LoadContext(ctx context.Context, out interface{}, id string) error {
 	if !l.owner.reflector.IsPtr(out) {
 		return errValNotAPointer
 	}
-	return l.queryById(out, id)
+	return l.queryById(ctx, out, id)
 }
 
 func (l *Link) From(from string) Iterator {
@@ -30,8 +40,27 @@ func (l *Link) Label(label string) Iterator {
 }
 
 func (l *Link) LoadMany(from, to, label string) Iterator {
+	return l.LoadManyContext(context.Background(), from, to, label)
+}
+
+func (l *Link) LoadManyContext(ctx context.Context, from, to, label string) Iterator {
 	buf := &bytes.Buffer{}
 	fmt.Fprintf(buf, "select body from %v where", l.name)
+	parray, err := l.writeMatch(buf, from, to, label)
+	if err != nil {
+		return errIter{err}
+	}
+
+	rows, err := l.db.QueryContext(ctx, string(buf.Bytes()), parray...)
+	if err != nil {
+		return errIter{err}
+	}
+	return newIterator(rows, l.owner)
+}
+
+// writeMatch appends the conditions that select the links with the
+// given from, to and label, empty values are ignored
+func (l *Link) writeMatch(buf *bytes.Buffer, from, to, label string) ([]interface{}, error) {
 	params := []struct {
 		name string
 		val  string
@@ -53,62 +82,84 @@ func (l *Link) LoadMany(from, to, label string) Iterator {
 	}
 
 	if len(parray) == 0 {
-		return errIter{errAtLeastOneParameter}
-	}
-
-	rows, err := l.owner.db.Query(string(buf.Bytes()), parray...)
-	if err != nil {
-		return errIter{err}
+		return nil, errAtLeastOneParameter
 	}
-	return newIterator(rows, l.owner.reflector)
+	return parray, nil
 }
 
 // Save will put the given object in the table.
 func (l *Link) Connect(val interface{}) (string, error) {
-	r := l.owner.reflector
+	return l.ConnectContext(context.Background(), val)
+}
+
+func (l *Link) ConnectContext(ctx context.Context, val interface{}) (string, error) {
+	r := &l.owner.reflector
 	if !r.IsPtr(val) {
 		return "", errValNotAPointer
 	}
 
 	id := r.GetFieldOrTag(val, "Id", `pgdoc:"Id"`, "").(string)
-	from := r.GetFieldOrTag(val, "From", `pgdoc:"From"`, "").(string)
-	to := r.GetFieldOrTag(val, "To", `pgdoc:"To"`, "").(string)
-	label := r.GetFieldOrTag(val, "Label", `pgdoc:"Label"`, "").(string)
+	from, to, label, err := l.endpoints(val)
+	if err != nil {
+		return "", err
+	}
+
+	if len(id) > 0 {
+		return l.update(ctx, id, from, to, label, val)
+	} else {
+		return l.insert(ctx, id, from, to, label, val)
+	}
+}
+
+// endpoints return the From, To and Label of the given link, if the
+// Label is empty the name of the type is used
+func (l *Link) endpoints(val interface{}) (from, to, label string, err error) {
+	return linkEndpoints(&l.owner.reflector, val)
+}
+
+func linkEndpoints(r *reflector.R, val interface{}) (from, to, label string, err error) {
+	from = r.GetFieldOrTag(val, "From", `pgdoc:"From"`, "").(string)
+	to = r.GetFieldOrTag(val, "To", `pgdoc:"To"`, "").(string)
+	label = r.GetFieldOrTag(val, "Label", `pgdoc:"Label"`, "").(string)
 
 	if len(label) == 0 {
 		_, label = r.GetTypeName(val)
 	}
 
 	if len(from) == 0 || len(to) == 0 || len(label) == 0 {
-		return "", errors.New("all links MUST HAVE a valid From, To and Label fields")
-	}
-
-	if len(id) > 0 {
-		return l.update(id, from, to, label, val)
-	} else {
-		return l.insert(id, from, to, label, val)
+		err = errInvalidLink
 	}
+	return
 }
 
-func (l *Link) newId() string {
+func (l *Link) newId() (string, error) {
 	return l.owner.newId(l.name)
 }
 
-func (l *Link) update(id, from, to, label string, val interface{}) (string, error) {
-	id = l.newId()
-	l.owner.reflector.SetField(val, "Id", id)
-	_, err := l.owner.db.Exec(fmt.Sprintf("update %v set _from = $2, _to = $3, label = $4, body = $5 where linkid = $1", l.name), id, from, to, label, jsonCol{val}.String())
-	return id, err
+func (l *Link) update(ctx context.Context, id, from, to, label string, val interface{}) (string, error) {
+	body, err := l.owner.encode(ctx, l.db, l.name, val)
+	if err != nil {
+		return "", err
+	}
+	_, err = l.db.ExecContext(ctx, fmt.Sprintf("update %v set _from = $2, _to = $3, label = $4, body = $5 where linkid = $1", l.name), id, from, to, label, body)
+	return id, l.constraintError(danglingError(err, from, to), from, to, label)
 }
 
-func (l *Link) insert(id, from, to, label string, val interface{}) (string, error) {
-	id = l.newId()
+func (l *Link) insert(ctx context.Context, id, from, to, label string, val interface{}) (string, error) {
+	id, err := l.newId()
+	if err != nil {
+		return "", err
+	}
 	l.owner.reflector.SetField(val, "Id", id)
-	_, err := l.owner.db.Exec(fmt.Sprintf("insert into %v (linkid, _from, _to, label, body) values ($1, $2, $3, $4, $5)", l.name), id, from, to, label, jsonCol{val}.String())
-	return id, err
+	body, err := l.owner.encode(ctx, l.db, l.name, val)
+	if err != nil {
+		return "", err
+	}
+	_, err = l.db.ExecContext(ctx, fmt.Sprintf("insert into %v (linkid, _from, _to, label, body) values ($1, $2, $3, $4, $5)", l.name), id, from, to, label, body)
+	return id, l.constraintError(danglingError(err, from, to), from, to, label)
 }
 
-func (l *Link) queryById(out interface{}, id string) error {
-	col := jsonCol{out}
-	return l.owner.db.QueryRow(fmt.Sprintf("select body from %v where linkid = $1", l.name), id).Scan(&col)
+func (l *Link) queryById(ctx context.Context, out interface{}, id string) error {
+	col := jsonCol{out, l.owner}
+	return l.db.QueryRowContext(ctx, fmt.Sprintf("select body from %v where linkid = $1", l.name), id).Scan(&col)
 }
@@ -5,13 +5,16 @@ package pgdoc
 import (
 	"amoraes.info/pgdoc/reflector"
 	"bytes"
-	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type (
@@ -22,6 +25,10 @@ type (
 		pk      bool
 		idx     string
 	}
+	columnInfo struct {
+		kind   string
+		length int
+	}
 	tableDef struct {
 		name string
 		def  []columnDef
@@ -29,17 +36,103 @@ type (
 	Table struct {
 		name  string
 		owner *Database
+		db    querier
+		// every version is kept in the history table
+		history bool
+		// documents expire ttl after being saved, zero means never
+		ttl time.Duration
 	}
 	Link struct {
 		name  string
 		owner *Database
+		db    querier
+	}
+	// querier is implemented by both *sql.DB and *sql.Tx
+	querier interface {
+		Exec(string, ...interface{}) (sql.Result, error)
+		Query(string, ...interface{}) (*sql.Rows, error)
+		QueryRow(string, ...interface{}) *sql.Row
+		ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+		QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+		QueryRowContext(context.Context, string, ...interface{}) *sql.Row
 	}
 	Database struct {
 		db        *sql.DB
 		reflector reflector.R
+		// used to open the connections used by Watch
+		dsn string
+		// protects the fields below
+		mu sync.RWMutex
+		// links that should be cleaned when a document is deleted
+		// from the given table
+		cascade map[string][]string
+		// the metadata table was created
+		metaReady bool
+		// the functions used by Patch were created
+		patchReady bool
+		// the function used to cast timestamps was created
+		tsReady bool
+		// tables registered as having documents that expire, see
+		// markExpiring
+		expiring map[string]bool
+		// schemas already loaded from the metadata table
+		schemas map[string]cachedSchema
+		// migrations registered for each table, sorted by version
+		migrations map[string][]migration
+		ids        IDGenerator
+		// encrypts the fields tagged with pgdoc:"encrypt", see
+		// SetKeyProvider
+		keys   KeyProvider
+		cipher *fieldCipher
 	}
+	// jsonCol reads and writes json columns. Scan decrypts the
+	// fields tagged with pgdoc:"encrypt" when owner is not nil, but
+	// plain never encrypts: documents are written with
+	// Database.encode, which validates and encrypts them, plain is
+	// only for values without tagged fields or already encrypted.
 	jsonCol struct {
-		val interface{}
+		val   interface{}
+		owner *Database
+	}
+	// Options used to connect to the database, zero values use the
+	// defaults from lib/pq and database/sql.
+	Options struct {
+		User     string
+		Password string
+		Database string
+		Host     string
+		Port     int
+		// disable if empty
+		SSLMode string
+		// Maximum time to wait while connecting
+		ConnectTimeout time.Duration
+		// Other parameters accepted by lib/pq, like application_name
+		Params map[string]string
+
+		MaxOpenConns    int
+		MaxIdleConns    int
+		ConnMaxLifetime time.Duration
+	}
+
+	// TableOptions control how tables and links are created, they
+	// are ignored if the table already exists.
+	TableOptions struct {
+		// Store the body using jsonb instead of json, jsonb tables
+		// accept GIN indexes and are faster to query.
+		JSONB bool
+		// Keep every version of the documents in <table>_history.
+		//
+		// Unlike the other options, History is also applied to
+		// existing tables. Ignored by links.
+		History bool
+		// Documents expire TTL after the last time they were saved,
+		// unless they have a field tagged with pgdoc:"ExpiresAt".
+		// Expired documents are hidden and removed by the reaper.
+		//
+		// Like History, TTL is also applied to existing tables and
+		// is ignored by links. Zero keeps the TTL of an existing
+		// table, use Table.SetTTL to remove it.
+		TTL time.Duration
 	}
 )
 
@@ -47,62 +140,169 @@ var (
 	errValNotAPointer      = errors.New("value isn't a pointer to a value")
 	errAtLeastOneParameter = errors.New("at least one parameter should be used")
 	ErrIndexAlreadyExists  = errors.New("index already exists on database")
+	// ErrConflict is returned when saving a document whose revision
+	// is older than the one stored in the database
+	ErrConflict = errors.New("document was changed by someone else")
+	// ErrGINRequiresJSONB is returned when creating a GIN index on
+	// a table that stores the body as json
+	ErrGINRequiresJSONB  = errors.New("GIN indexes require a jsonb body, see MigrateToJSONB")
+	errUniqueWithoutPath = errors.New("unique indexes require a property path")
+)
+
+const (
+	revTag = `pgdoc:"Rev"`
 )
 
 func OpenDatabase(user, password, database, host string) (*Database, error) {
-	db, err := sql.Open("postgres", fmt.Sprintf("dbname=%v password=%v user=%v host=%v sslmode=disable", database, user, password, host))
+	return Open(Options{
+		User:     user,
+		Password: password,
+		Database: database,
+		Host:     host,
+	})
+}
+
+// Open connects to the database described by opts and configures
+// the connection pool.
+func Open(opts Options) (*Database, error) {
+	d, err := OpenDSN(opts.DSN())
+	if err != nil {
+		return nil, err
+	}
+	opts.configure(d.db)
+	return d, nil
+}
+
+// OpenDSN connects using a lib/pq connection string, both the
+// key=value and the postgres:// URL formats are accepted.
+func OpenDSN(dsn string) (*Database, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
 	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &Database{db, reflector.R{}}, nil
+	return &Database{db: db, dsn: dsn}, nil
+}
+
+// WrapDB uses a connection pool opened elsewhere, db must use the
+// lib/pq driver.
+//
+// Since the connection string is unknown, Watch is not available.
+func WrapDB(db *sql.DB) *Database {
+	return &Database{db: db}
+}
+
+// DB return the underlying connection pool
+func (d *Database) DB() *sql.DB {
+	return d.db
 }
 
 func (d *Database) Table(name string) (*Table, error) {
+	return d.table(d.db, name, TableOptions{})
+}
+
+func (d *Database) Link(name string) (*Link, error) {
+	return d.link(d.db, name, TableOptions{})
+}
+
+func (d *Database) TableWithOptions(name string, opts TableOptions) (*Table, error) {
+	return d.table(d.db, name, opts)
+}
+
+func (d *Database) LinkWithOptions(name string, opts TableOptions) (*Link, error) {
+	return d.link(d.db, name, opts)
+}
+
+// MigrateToJSONB converts the body of an existing table or link
+// from json to jsonb, indexes over the body are rebuilt by postgresql.
+func (d *Database) MigrateToJSONB(tableOrLink string) error {
+	kind, err := d.bodyType(tableOrLink)
+	if err != nil {
+		return err
+	}
+	if kind == "jsonb" {
+		return nil
+	}
+	_, err = d.db.Exec(fmt.Sprintf("alter table %v alter column body type jsonb using body::jsonb", tableOrLink))
+	return err
+}
+
+func (d *Database) bodyType(tableOrLink string) (string, error) {
+	var kind string
+	err := d.db.QueryRow("select data_type from information_schema.columns where table_name = $1 and column_name = 'body'", tableOrLink).Scan(&kind)
+	return kind, err
+}
+
+func (d *Database) table(db querier, name string, opts TableOptions) (*Table, error) {
 	td := tableDef{
 		name: name,
 		def: []columnDef{
 			columnDef{
 				name:    "docid",
-				kind:    "varchar(40)",
+				kind:    "varchar(100)",
 				pk:      true,
 				notnull: "not null",
 			},
+			columnDef{
+				name:    "rev",
+				kind:    "bigint",
+				notnull: "not null default 1",
+			},
 			columnDef{
 				name:    "body",
-				kind:    "json",
+				kind:    opts.bodyKind(),
 				notnull: "not null",
 			},
+			columnDef{
+				name: "expires_at",
+				kind: "timestamptz",
+				idx:  "btree",
+			},
 		},
 	}
-	if err := d.ensure(&td); err != nil {
+	if err := d.ensure(db, &td); err != nil {
 		return nil, err
 	}
-	return &Table{name, d}, nil
+	tbl := &Table{name: name, owner: d, db: db}
+	var err error
+	if opts.History {
+		err = d.ensureHistory(db, name)
+		tbl.history = true
+	} else {
+		tbl.history, err = historyDef(name).exists(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tbl.ttl, err = d.loadTTL(db, name, opts); err != nil {
+		return nil, err
+	}
+	return tbl, nil
 }
 
-func (d *Database) Link(name string) (*Link, error) {
+func (d *Database) link(db querier, name string, opts TableOptions) (*Link, error) {
 	td := tableDef{
 		name: name,
 		def: []columnDef{
 			columnDef{
 				name:    "linkid",
-				kind:    "varchar(40)",
+				kind:    "varchar(100)",
 				notnull: "not null",
 				pk:      true,
 			},
 			columnDef{
 				name:    "_from",
-				kind:    "varchar(40)",
+				kind:    "varchar(100)",
 				notnull: "not null",
 				idx:     "hash",
 			},
 			columnDef{
 				name:    "_to",
-				kind:    "varchar(40)",
+				kind:    "varchar(100)",
 				notnull: "not null",
 				idx:     "hash",
 			},
@@ -114,15 +314,15 @@ func (d *Database) Link(name string) (*Link, error) {
 			},
 			columnDef{
 				name:    "body",
-				kind:    "json",
+				kind:    opts.bodyKind(),
 				notnull: "not null",
 			},
 		},
 	}
-	if err := d.ensure(&td); err != nil {
+	if err := d.ensure(db, &td); err != nil {
 		return nil, err
 	}
-	return &Link{name, d}, nil
+	return &Link{name, d, db}, nil
 }
 
 // Truncate remove all data from the given table or link and
@@ -132,6 +332,28 @@ func (d *Database) Truncate(tblOrLink string) error {
 	return err
 }
 
+// CascadeLinks makes every delete on the given table also remove
+// the rows from links whose _from or _to points to the deleted
+// documents.
+func (d *Database) CascadeLinks(table string, links ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cascade == nil {
+		d.cascade = make(map[string][]string)
+	}
+	for _, l := range links {
+		if !contains(d.cascade[table], l) {
+			d.cascade[table] = append(d.cascade[table], l)
+		}
+	}
+}
+
+func (d *Database) cascadeFor(table string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cascade[table]
+}
+
 func (d *Database) Unique(tableOrLink string, idxName string, propPath ...string) error {
 	if exists, err := d.indexExistsOn(tableOrLink, idxName); err != nil {
 		return err
@@ -143,6 +365,11 @@ func (d *Database) Unique(tableOrLink string, idxName string, propPath ...string
 	return d.createIndex(tableOrLink, idxName, true, propPath...)
 }
 
+// CreateIndex creates an index over the text value of the given
+// property path.
+//
+// When propPath is empty a GIN index over the whole body is created,
+// which speeds up Contains queries. GIN indexes require a jsonb body.
 func (d *Database) CreateIndex(tableOrLink string, idxName string, propPath ...string) error {
 	if exists, err := d.indexExistsOn(tableOrLink, idxName); err != nil {
 		return err
@@ -174,36 +401,142 @@ func (d *Database) dropIndex(tblName, idxName string) error {
 }
 
 func (d *Database) createIndex(tblLnk string, idxname string, unique bool, propPath ...string) error {
-	uniqueStr := ""
+	if len(propPath) == 0 {
+		return d.createGINIndex(tblLnk, idxname, unique)
+	}
+	spec := IndexSpec{
+		Name:   idxname,
+		Fields: []IndexField{{Path: propPath}},
+		Unique: unique,
+	}
+	cmd, err := spec.sql(tblLnk)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(cmd)
+	return err
+}
+
+func (d *Database) createGINIndex(tblLnk string, idxname string, unique bool) error {
 	if unique {
-		uniqueStr = "UNIQUE"
+		return errUniqueWithoutPath
+	}
+	if kind, err := d.bodyType(tblLnk); err != nil {
+		return err
+	} else if kind != "jsonb" {
+		return ErrGINRequiresJSONB
 	}
-	cmd := fmt.Sprintf("CREATE %v INDEX idx_%v_%v on %v ((body#>>'{%v}'));", uniqueStr, tblLnk, idxname, tblLnk, strings.Join(propPath, ","))
-	_, err := d.db.Exec(cmd)
+	_, err := d.db.Exec(fmt.Sprintf("CREATE INDEX idx_%v_%v on %v using gin (body jsonb_path_ops);", tblLnk, idxname, tblLnk))
 	return err
 }
 
-func (d *Database) ensure(def *tableDef) error {
+func (d *Database) ensure(db querier, def *tableDef) error {
 	var exists bool
 	var err error
-	if exists, err = def.exists(d); err != nil {
+	if exists, err = def.exists(db); err != nil {
 		return err
 	}
 	if exists {
-		return nil
+		return def.upgrade(db)
 	}
-	return def.create(d)
+	return def.create(db)
 }
 
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
-func (d *Database) newId(prefix string) string {
-	return uuid.New()
+// SetIDGenerator changes how new ids are generated, by default ids
+// are ULIDs prefixed by the table or link name, like
+// users_01ARZ3NDEKTSV4RRFFQ69G5FAV. Use UUIDGenerator{} to keep the
+// random UUIDs of older versions.
+func (d *Database) SetIDGenerator(g IDGenerator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ids = g
+}
+
+func (d *Database) newId(prefix string) (string, error) {
+	d.mu.RLock()
+	g := d.ids
+	d.mu.RUnlock()
+	if g == nil {
+		g = defaultIds
+	}
+	return g.NewID(prefix)
+}
+
+// DSN return the connection string described by the options
+func (o Options) DSN() string {
+	params := map[string]string{
+		"user":     o.User,
+		"password": o.Password,
+		"dbname":   o.Database,
+		"host":     o.Host,
+		"sslmode":  o.SSLMode,
+	}
+	if len(o.SSLMode) == 0 {
+		params["sslmode"] = "disable"
+	}
+	if o.Port > 0 {
+		params["port"] = fmt.Sprintf("%d", o.Port)
+	}
+	if o.ConnectTimeout > 0 {
+		// lib/pq only accepts seconds
+		secs := int((o.ConnectTimeout + time.Second - 1) / time.Second)
+		params["connect_timeout"] = fmt.Sprintf("%d", secs)
+	}
+	for k, v := range o.Params {
+		params[k] = v
+	}
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for i, k := range keys {
+		if i > 0 {
+			fmt.Fprintf(buf, " ")
+		}
+		fmt.Fprintf(buf, "%v='%v'", k, quote.Replace(params[k]))
+	}
+	return string(buf.Bytes())
+}
+
+func (o Options) configure(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
 }
 
-func (jc jsonCol) String() string {
+func (o TableOptions) bodyKind() string {
+	if o.JSONB {
+		return "jsonb"
+	}
+	return "json"
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// plain return val encoded as json, as is
+func (jc jsonCol) plain() string {
 	buf := &bytes.Buffer{}
 	enc := json.NewEncoder(buf)
 	enc.Encode(jc.val)
@@ -216,10 +549,14 @@ func (jc jsonCol) Scan(in interface{}) error {
 	case []byte:
 		buf = in
 	case string:
-		buf = []byte(buf)
+		buf = []byte(in)
 	default:
 		return fmt.Errorf("cannot decode value %T into a jsonCol", in)
 	}
+	buf, err := jc.decrypt(buf)
+	if err != nil {
+		return err
+	}
 	dec := json.NewDecoder(bytes.NewBuffer(buf))
 	return dec.Decode(jc.val)
 }
@@ -1,8 +1,16 @@
 package pgdoc
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func mustOpenDb(t *testing.T) *Database {
@@ -261,3 +269,1858 @@ func TestCreateLink(t *testing.T) {
 	_ = tbl
 	_ = lnk
 }
+
+func TestFind(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("finddocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+
+	type person struct {
+		Id   string
+		Name string
+		Age  int
+	}
+
+	persons := []person{
+		{Name: "Bob", Age: 30},
+		{Name: "Tom", Age: 20},
+		{Name: "Ann", Age: 40},
+	}
+	for i := range persons {
+		if _, err := tbl.Save(&persons[i]); err != nil {
+			t.Fatalf("error saving %v: %v", persons[i].Name, err)
+		}
+	}
+
+	it := tbl.Find().Where(Greater, 25, "Age").OrderBy("Name").Iter()
+	var names []string
+	for it.Next() {
+		var p person
+		if err := it.Scan(&p); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		}
+		names = append(names, p.Name)
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+	if !reflect.DeepEqual(names, []string{"Ann", "Bob"}) {
+		t.Errorf("expecting [Ann Bob] got %v", names)
+	}
+
+	it = tbl.Find().Where(In, []string{"Tom", "Bob"}, "Name").Where(Exists, nil, "Age").OrderByDesc("Name").Limit(1).Iter()
+	count := 0
+	for it.Next() {
+		var p person
+		if err := it.Scan(&p); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		} else if p != persons[1] {
+			t.Errorf("expecting %v got %v", persons[1], p)
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expecting only one document got %v", count)
+	}
+
+	it = tbl.Find().Where(Like, "B%", "Name").Where(NotEqual, "Bob", "Name").Iter()
+	if it.Next() {
+		t.Errorf("should not find any document")
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+
+	it = tbl.Find().Where(In, "Bob", "Name").Iter()
+	if it.Next() || it.Err() != errInNeedsSlice {
+		t.Errorf("expecting %v got %v", errInNeedsSlice, it.Err())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("deletedocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	lnk, err := db.Link("deletelinks")
+	if err != nil {
+		t.Fatalf("error creating links: %v", err)
+	}
+	db.CascadeLinks(tbl.Name(), lnk.Name())
+
+	persons := []struct {
+		Id   string
+		Name string
+	}{
+		{Name: "Bob"},
+		{Name: "Tom"},
+		{Name: "Ann"},
+	}
+	for i := range persons {
+		if _, err := tbl.Save(&persons[i]); err != nil {
+			t.Fatalf("error saving %v: %v", persons[i].Name, err)
+		}
+	}
+
+	edge := struct {
+		Id    string
+		From  string
+		To    string
+		Label string
+	}{
+		From:  persons[0].Id,
+		To:    persons[1].Id,
+		Label: "friend-of",
+	}
+	if _, err := lnk.Connect(&edge); err != nil {
+		t.Fatalf("error saving link: %v", err)
+	}
+
+	if err := tbl.Delete(persons[1].Id); err != nil {
+		t.Fatalf("error deleting tom: %v", err)
+	}
+	if err := tbl.Load(&persons[1], persons[1].Id); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+	if err := lnk.Load(&edge, edge.Id); err != sql.ErrNoRows {
+		t.Errorf("link should have been removed, got %v", err)
+	}
+
+	if count, err := tbl.DeleteWhere(tbl.Find().Where(Equals, "Ann", "Name")); err != nil {
+		t.Fatalf("error deleting ann: %v", err)
+	} else if count != 1 {
+		t.Errorf("expecting one document removed got %v", count)
+	}
+
+	if _, err := tbl.DeleteWhere(tbl.Find()); err != errAtLeastOneParameter {
+		t.Errorf("expecting %v got %v", errAtLeastOneParameter, err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	type person struct {
+		Id   string
+		Name string
+	}
+
+	var bob, tom person
+	errAbort := errors.New("abort")
+	err := db.Transaction(func(tx *Tx) error {
+		tbl, err := tx.Table("txdocs")
+		if err != nil {
+			return err
+		}
+		bob.Name = "Bob"
+		if _, err := tbl.Save(&bob); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expecting %v got %v", errAbort, err)
+	}
+
+	err = db.Transaction(func(tx *Tx) error {
+		tbl, err := tx.Table("txdocs")
+		if err != nil {
+			return err
+		}
+		lnk, err := tx.Link("txlinks")
+		if err != nil {
+			return err
+		}
+		tom.Name = "Tom"
+		if _, err := tbl.Save(&tom); err != nil {
+			return err
+		}
+		_, err = lnk.Connect(&struct {
+			Id    string
+			From  string
+			To    string
+			Label string
+		}{From: tom.Id, To: tom.Id, Label: "self"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error committing transaction: %v", err)
+	}
+
+	tbl, err := db.Table("txdocs")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	var other person
+	if err := tbl.Load(&other, bob.Id); err != sql.ErrNoRows {
+		t.Errorf("bob should have been rolled back, got %v", err)
+	}
+	if err := tbl.Load(&other, tom.Id); err != nil {
+		t.Errorf("error loading tom: %v", err)
+	} else if other != tom {
+		t.Errorf("expecting %v got %v", tom, other)
+	}
+
+	err = db.Transaction(func(tx *Tx) error {
+		panic("boom")
+	})
+	if err == nil {
+		t.Errorf("a panic should be reported as an error")
+	}
+}
+
+func TestRevision(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("revdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+
+	type counter struct {
+		Id    string
+		Rev   int64
+		Value int
+	}
+
+	c := counter{Value: 1}
+	if _, err := tbl.Save(&c); err != nil {
+		t.Fatalf("error saving counter: %v", err)
+	}
+	if c.Rev != 1 {
+		t.Errorf("expecting revision 1 got %v", c.Rev)
+	}
+
+	var first, second counter
+	if err := tbl.Load(&first, c.Id); err != nil {
+		t.Fatalf("error loading counter: %v", err)
+	}
+	if err := tbl.Load(&second, c.Id); err != nil {
+		t.Fatalf("error loading counter: %v", err)
+	}
+
+	first.Value++
+	if _, err := tbl.Save(&first); err != nil {
+		t.Fatalf("error saving first copy: %v", err)
+	}
+	if first.Rev != 2 {
+		t.Errorf("expecting revision 2 got %v", first.Rev)
+	}
+
+	second.Value += 10
+	if _, err := tbl.Save(&second); err != ErrConflict {
+		t.Fatalf("expecting %v got %v", ErrConflict, err)
+	}
+	if second.Rev != 1 {
+		t.Errorf("revision should be kept after a conflict, got %v", second.Rev)
+	}
+
+	if err := tbl.Load(&second, c.Id); err != nil {
+		t.Fatalf("error reloading counter: %v", err)
+	}
+	if second != first {
+		t.Errorf("expecting %v got %v", first, second)
+	}
+}
+
+func TestJSONBContains(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.TableWithOptions("jsonbdocs", TableOptions{JSONB: true})
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	if err = db.CreateIndex(tbl.Name(), "body"); err != nil && err != ErrIndexAlreadyExists {
+		t.Fatalf("error creating gin index: %v", err)
+	}
+
+	type person struct {
+		Id   string
+		Name string
+		Tags []string
+	}
+	persons := []person{
+		{Name: "Bob", Tags: []string{"admin", "dev"}},
+		{Name: "Tom", Tags: []string{"dev"}},
+	}
+	for i := range persons {
+		if _, err := tbl.Save(&persons[i]); err != nil {
+			t.Fatalf("error saving %v: %v", persons[i].Name, err)
+		}
+	}
+
+	it := tbl.Contains([]byte(`{"Tags": ["admin"]}`))
+	count := 0
+	for it.Next() {
+		var p person
+		if err := it.Scan(&p); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		} else if p.Name != "Bob" {
+			t.Errorf("expecting Bob got %v", p.Name)
+		}
+		count++
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+	if count != 1 {
+		t.Errorf("expecting one document got %v", count)
+	}
+
+	plain, err := db.Table("jsondocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.CreateIndex(plain.Name(), "body"); err != ErrGINRequiresJSONB && err != ErrIndexAlreadyExists {
+		t.Errorf("expecting %v got %v", ErrGINRequiresJSONB, err)
+	}
+	if err = db.MigrateToJSONB(plain.Name()); err != nil {
+		t.Fatalf("error migrating table: %v", err)
+	}
+	if err = db.CreateIndex(plain.Name(), "body"); err != nil && err != ErrIndexAlreadyExists {
+		t.Errorf("error creating gin index after migration: %v", err)
+	}
+}
+
+func TestSaveMany(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("bulkdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	if err = db.Unique(tbl.Name(), "name", "Name"); err != nil && err != ErrIndexAlreadyExists {
+		t.Fatalf("error creating unique index: %v", err)
+	}
+
+	type person struct {
+		Id   string
+		Name string
+	}
+	persons := []person{{Name: "Bob"}, {Name: "Tom"}, {Name: "Ann"}}
+	if err := tbl.SaveMany(persons); err != nil {
+		t.Fatalf("error saving persons: %v", err)
+	}
+	for _, p := range persons {
+		var other person
+		if len(p.Id) == 0 {
+			t.Errorf("id not assigned to %v", p.Name)
+		} else if err := tbl.Load(&other, p.Id); err != nil {
+			t.Errorf("error loading %v: %v", p.Name, err)
+		} else if other != p {
+			t.Errorf("expecting %v got %v", p, other)
+		}
+	}
+
+	more := []*person{{Name: "Joe"}, {Name: "Bob"}, {Name: "Max"}}
+	err = tbl.SaveMany(more)
+	if bulk, ok := err.(*BulkError); !ok {
+		t.Fatalf("expecting a *BulkError got %v", err)
+	} else if len(bulk.Rows) != 1 || bulk.Rows[0].Index != 1 {
+		t.Errorf("only the second row should fail, got %v", bulk.Rows)
+	}
+	var joe person
+	if err := tbl.Load(&joe, more[0].Id); err != nil {
+		t.Errorf("rows without errors should be saved: %v", err)
+	}
+
+	lnk, err := db.Link("bulklinks")
+	if err != nil {
+		t.Fatalf("error creating links: %v", err)
+	}
+	type knows struct {
+		Id   string
+		From string
+		To   string
+	}
+	edges := []knows{
+		{From: persons[0].Id, To: persons[1].Id},
+		{From: persons[1].Id},
+		{Id: "knows-" + persons[1].Id, From: persons[1].Id, To: persons[0].Id},
+	}
+	err = lnk.ConnectMany(edges)
+	if bulk, ok := err.(*BulkError); !ok {
+		t.Fatalf("expecting a *BulkError got %v", err)
+	} else if len(bulk.Rows) != 1 || bulk.Rows[0].Err != errInvalidLink {
+		t.Errorf("expecting %v got %v", errInvalidLink, bulk.Rows)
+	}
+	var other knows
+	if err := lnk.Load(&other, edges[0].Id); err != nil {
+		t.Errorf("error loading link: %v", err)
+	} else if other != edges[0] {
+		t.Errorf("expecting %v got %v", edges[0], other)
+	}
+	if err := lnk.Load(&other, "knows-"+persons[1].Id); err != nil {
+		t.Errorf("links should keep their id: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("watchdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := tbl.Watch(ctx, true)
+	if err != nil {
+		t.Fatalf("error watching table: %v", err)
+	}
+
+	doc := struct {
+		Id   string
+		Name string
+	}{Name: "Bob"}
+	if _, err := tbl.Save(&doc); err != nil {
+		t.Fatalf("error saving doc: %v", err)
+	}
+	if err := tbl.Delete(doc.Id); err != nil {
+		t.Fatalf("error deleting doc: %v", err)
+	}
+
+	for _, op := range []EventOp{Inserted, Deleted} {
+		select {
+		case ev := <-events:
+			if ev.Op != op || ev.Id != doc.Id {
+				t.Errorf("expecting %v %v got %v %v", op, doc.Id, ev.Op, ev.Id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v", op)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("schemadocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	db.RemoveSchema(tbl.Name())
+
+	// another connection, that saves before the schema exists
+	other := mustOpenDb(t)
+	defer other.Close()
+	otherTbl, err := other.Table(tbl.Name())
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	if _, err = otherTbl.Save(&struct{ Id string }{}); err != nil {
+		t.Fatalf("error saving without a schema: %v", err)
+	}
+
+	err = db.SetSchema(tbl.Name(), []byte(`{
+		"type": "object",
+		"required": ["Name"],
+		"properties": {"Name": {"type": "string", "minLength": 1}}
+	}`))
+	if err != nil {
+		t.Fatalf("error setting schema: %v", err)
+	}
+	defer db.RemoveSchema(tbl.Name())
+
+	doc := struct {
+		Id   string
+		Name string
+	}{}
+	_, err = tbl.Save(&doc)
+	if verr, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expecting a *ValidationError got %v", err)
+	} else if len(verr.Errors) != 1 || verr.Errors[0].Path != "/Name" {
+		t.Errorf("expecting an error at /Name got %v", verr.Errors)
+	}
+
+	doc.Name = "Bob"
+	if _, err = tbl.Save(&doc); err != nil {
+		t.Errorf("error saving valid document: %v", err)
+	}
+
+	// the other connection cached the absence of the schema, and
+	// reads it from the database once the cache expires
+	doc.Id, doc.Name = "", ""
+	if _, err = otherTbl.Save(&doc); err != nil {
+		t.Errorf("the absence of the schema should be cached: %v", err)
+	}
+	defer func(ttl time.Duration) { schemaCacheTTL = ttl }(schemaCacheTTL)
+	schemaCacheTTL = 0
+	doc.Id = ""
+	if _, err = otherTbl.Save(&doc); err == nil {
+		t.Errorf("schema should be loaded from the database")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.TableWithOptions("historydocs", TableOptions{History: true})
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+
+	type doc struct {
+		Id    string
+		Rev   int64
+		Value string
+	}
+
+	d := doc{Value: "first"}
+	if _, err := tbl.Save(&d); err != nil {
+		t.Fatalf("error saving doc: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	d.Value = "second"
+	if _, err := tbl.Save(&d); err != nil {
+		t.Fatalf("error updating doc: %v", err)
+	}
+
+	var values []string
+	it := tbl.History(d.Id)
+	for it.Next() {
+		var old doc
+		if err := it.Scan(&old); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		}
+		values = append(values, old.Value)
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+	if !reflect.DeepEqual(values, []string{"first", "second"}) {
+		t.Errorf("expecting [first second] got %v", values)
+	}
+
+	var old doc
+	if err := tbl.LoadAt(&old, d.Id, between); err != nil {
+		t.Fatalf("error loading old version: %v", err)
+	} else if old.Value != "first" || old.Rev != 1 {
+		t.Errorf("expecting the first revision got %v", old)
+	}
+
+	if err := tbl.Delete(d.Id); err != nil {
+		t.Fatalf("error deleting doc: %v", err)
+	}
+	if err := tbl.LoadAt(&old, d.Id, time.Now()); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+
+	plain, err := db.Table("mydocs")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	if err := plain.LoadAt(&old, d.Id, time.Now()); err != errNoHistory {
+		t.Errorf("expecting %v got %v", errNoHistory, err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("prefixeddocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+
+	doc := struct {
+		Id string
+	}{}
+	db.SetIDGenerator(&PrefixedGenerator{Gen: NewSequenceGenerator(db)})
+	if _, err := tbl.Save(&doc); err != nil {
+		t.Fatalf("error saving doc: %v", err)
+	}
+	if !strings.HasPrefix(doc.Id, "prefixeddocs_") {
+		t.Errorf("expecting a prefixed id got %v", doc.Id)
+	}
+
+	first := doc.Id
+	doc.Id = ""
+	if _, err := tbl.Save(&doc); err != nil {
+		t.Fatalf("error saving doc: %v", err)
+	}
+	if doc.Id == first {
+		t.Errorf("ids should be unique, got %v twice", first)
+	}
+}
+
+func TestOptionsDSN(t *testing.T) {
+	opts := Options{
+		User:           "graph",
+		Password:       `it's a \secret`,
+		Database:       "graph",
+		Host:           "localhost",
+		Port:           5433,
+		ConnectTimeout: 1500 * time.Millisecond,
+		Params:         map[string]string{"application_name": "pgdoc"},
+	}
+	expected := `application_name='pgdoc' connect_timeout='2' dbname='graph' host='localhost' password='it\'s a \\secret' port='5433' sslmode='disable' user='graph'`
+	if dsn := opts.DSN(); dsn != expected {
+		t.Errorf("expecting %v got %v", expected, dsn)
+	}
+}
+
+func TestContext(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("mydocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	doc := struct {
+		Id   string
+		Name string
+	}{Name: "Bob"}
+	if _, err := tbl.SaveContext(ctx, &doc); err != context.Canceled {
+		t.Errorf("expecting %v got %v", context.Canceled, err)
+	}
+	if it := tbl.Find().Where(Equals, "Bob", "Name").IterContext(ctx); it.Next() || it.Err() != context.Canceled {
+		t.Errorf("expecting %v got %v", context.Canceled, it.Err())
+	}
+}
+
+func TestPatch(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("patchdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	db.DropIndex(tbl.Name(), "patchdocs_email")
+	if err = db.Unique(tbl.Name(), "patchdocs_email", "Email"); err != nil {
+		t.Fatalf("error creating index: %v", err)
+	}
+
+	type person struct {
+		Id    string
+		Rev   int64
+		Name  string
+		Email string
+		Tags  []string
+	}
+
+	bob := person{Name: "Bob", Email: "bob@email.com", Tags: []string{"admin"}}
+	ann := person{Name: "Ann", Email: "ann@email.com"}
+	for _, p := range []*person{&bob, &ann} {
+		if _, err := tbl.Save(p); err != nil {
+			t.Fatalf("error saving %v: %v", p.Name, err)
+		}
+	}
+
+	var out person
+	if err := tbl.Patch(&out, bob.Id, map[string]interface{}{"Name": "Robert", "Tags": nil}); err != nil {
+		t.Fatalf("error applying merge patch: %v", err)
+	}
+	if out.Name != "Robert" || out.Email != bob.Email || out.Tags != nil || out.Rev != 2 {
+		t.Errorf("unexpected document after merge patch: %v", out)
+	}
+
+	ops := []PatchOp{
+		{Op: "test", Path: "/Name", Value: "Robert"},
+		{Op: "add", Path: "/Tags", Value: []string{"dev"}},
+		{Op: "add", Path: "/Tags/-", Value: "ops"},
+		{Op: "copy", From: "/Email", Path: "/Name"},
+	}
+	if err := tbl.Patch(&out, bob.Id, ops); err != nil {
+		t.Fatalf("error applying json patch: %v", err)
+	}
+	if out.Name != bob.Email || !reflect.DeepEqual(out.Tags, []string{"dev", "ops"}) || out.Rev != 3 {
+		t.Errorf("unexpected document after json patch: %v", out)
+	}
+
+	if err := tbl.Patch(nil, bob.Id, []PatchOp{{Op: "test", Path: "/Name", Value: "Bob"}}); err == nil {
+		t.Errorf("a failed test operation should abort the patch")
+	}
+	if err := tbl.Patch(nil, ann.Id, json.RawMessage(`{"Email": "bob@email.com"}`)); err == nil {
+		t.Errorf("patch should respect unique indexes")
+	}
+	if err := tbl.Patch(nil, "invalid", map[string]string{"Name": "Tom"}); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+
+	// Find only reads the body, which must carry the new revision
+	if err := tbl.Patch(nil, ann.Id, map[string]string{"Name": "Anna"}); err != nil {
+		t.Fatalf("error patching: %v", err)
+	}
+	var found []person
+	if err := tbl.Find().Where(Equals, ann.Id, "Id").Iter().ScanAll(&found); err != nil || len(found) != 1 {
+		t.Fatalf("expecting ann got %v: %v", found, err)
+	}
+	if found[0].Rev != 2 {
+		t.Errorf("expecting rev 2 got %v", found[0].Rev)
+	}
+	found[0].Name = "Ann"
+	if _, err := tbl.Save(&found[0]); err != nil {
+		t.Errorf("error saving a patched document: %v", err)
+	}
+
+	// patches renew the expiration of the documents
+	ttlTbl, err := db.TableWithOptions("patchttldocs", TableOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	tom := person{Name: "Tom"}
+	if _, err := ttlTbl.Save(&tom); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	if _, err := db.DB().Exec("update patchttldocs set expires_at = now() + interval '1 minute' where docid = $1", tom.Id); err != nil {
+		t.Fatalf("error changing the expiration: %v", err)
+	}
+	if err := ttlTbl.Patch(nil, tom.Id, map[string]string{"Name": "Thomas"}); err != nil {
+		t.Fatalf("error patching: %v", err)
+	}
+	var renewed bool
+	err = db.DB().QueryRow("select expires_at > now() + interval '30 minutes' from patchttldocs where docid = $1", tom.Id).Scan(&renewed)
+	if err != nil || !renewed {
+		t.Errorf("patch should renew the expiration: %v", err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.TableWithOptions("dumpdocs", TableOptions{JSONB: true})
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	lnk, err := db.Link("dumplinks")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	for _, name := range []string{tbl.Name(), lnk.Name()} {
+		if err = db.Truncate(name); err != nil {
+			t.Fatalf("error truncating %v: %v", name, err)
+		}
+	}
+	db.DropIndex(tbl.Name(), "dumpdocs_name")
+	if err = db.Unique(tbl.Name(), "dumpdocs_name", "Name"); err != nil {
+		t.Fatalf("error creating index: %v", err)
+	}
+
+	type person struct {
+		Id   string
+		Name string
+	}
+	type friend struct {
+		Id   string
+		From string
+		To   string
+	}
+
+	bob, ann := person{Name: "Bob"}, person{Name: "Ann"}
+	for _, p := range []*person{&bob, &ann} {
+		if _, err := tbl.Save(p); err != nil {
+			t.Fatalf("error saving %v: %v", p.Name, err)
+		}
+	}
+	f := friend{From: bob.Id, To: ann.Id}
+	if _, err := lnk.Connect(&f); err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Dump(buf, tbl.Name(), lnk.Name()); err != nil {
+		t.Fatalf("error dumping: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines < 6 {
+		t.Errorf("expecting at least 6 records got %v: %v", lines, buf.String())
+	}
+
+	for _, name := range []string{tbl.Name(), lnk.Name()} {
+		if err = db.Truncate(name); err != nil {
+			t.Fatalf("error truncating %v: %v", name, err)
+		}
+	}
+	if err := db.DropIndex(tbl.Name(), "dumpdocs_name"); err != nil {
+		t.Fatalf("error dropping index: %v", err)
+	}
+
+	if err := db.Restore(buf); err != nil {
+		t.Fatalf("error restoring: %v", err)
+	}
+	var loaded person
+	if err := tbl.Load(&loaded, bob.Id); err != nil || loaded != bob {
+		t.Errorf("expecting %v got %v: %v", bob, loaded, err)
+	}
+	var lf friend
+	if err := lnk.Load(&lf, f.Id); err != nil || lf != f {
+		t.Errorf("expecting %v got %v: %v", f, lf, err)
+	}
+	if exists, err := db.indexExistsOn(tbl.Name(), "dumpdocs_name"); err != nil || !exists {
+		t.Errorf("index should be restored: %v", err)
+	}
+
+	if err := db.Restore(strings.NewReader(`{"kind": "invalid", "name": "dumpdocs"}`)); err == nil {
+		t.Errorf("restore should fail with an invalid record")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("searchdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	db.DropTextIndex(tbl.Name(), "searchdocs_text")
+	if err = db.CreateTextIndex(tbl.Name(), "searchdocs_text", "english", []string{"Title"}, []string{"Body"}); err != nil {
+		t.Fatalf("error creating text index: %v", err)
+	}
+
+	type article struct {
+		Id        string
+		Title     string
+		Body      string
+		Rank      float64 `json:"-" pgdoc:"Rank"`
+		Highlight string  `json:"-" pgdoc:"Highlight"`
+	}
+
+	articles := []article{
+		{Title: "Cooking pasta", Body: "Boil the water and add the pasta"},
+		{Title: "Databases", Body: "Postgresql stores json documents"},
+		{Title: "Pasta and databases", Body: "Nothing to see"},
+	}
+	for i := range articles {
+		if _, err := tbl.Save(&articles[i]); err != nil {
+			t.Fatalf("error saving %v: %v", articles[i].Title, err)
+		}
+	}
+
+	it := tbl.Search("pasta -databases").Highlight().Iter()
+	var found []article
+	for it.Next() {
+		var a article
+		if err := it.Scan(&a); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		}
+		found = append(found, a)
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+	if len(found) != 1 || found[0].Id != articles[0].Id {
+		t.Fatalf("expecting only %v got %v", articles[0].Title, found)
+	}
+	if found[0].Rank <= 0 || !strings.Contains(found[0].Highlight, "<b>") {
+		t.Errorf("expecting rank and highlight got %v", found[0])
+	}
+
+	// fields without the tags are left alone, whatever their type
+	var plain struct {
+		Id        string
+		Rank      string
+		Highlight bool
+	}
+	it = tbl.Search("pasta").Highlight().Iter()
+	if !it.Next() || it.Scan(&plain) != nil || plain.Rank != "" || plain.Highlight {
+		t.Errorf("untagged fields should not be set, got %v: %v", plain, it.Err())
+	}
+	it.Close()
+
+	other, err := db.Table("searchnoindex")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if it := other.Search("pasta").Iter(); it.Next() || it.Err() != errNoTextIndex {
+		t.Errorf("expecting %v got %v", errNoTextIndex, it.Err())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.TableWithOptions("ttldocs", TableOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+
+	type session struct {
+		Id        string
+		User      string
+		ExpiresAt time.Time `pgdoc:"ExpiresAt"`
+	}
+
+	live := session{User: "bob"}
+	dead := session{User: "bob", ExpiresAt: time.Now().Add(-time.Minute)}
+	for _, s := range []*session{&live, &dead} {
+		if _, err := tbl.Save(s); err != nil {
+			t.Fatalf("error saving session: %v", err)
+		}
+	}
+
+	var loaded session
+	if err := tbl.Load(&loaded, live.Id); err != nil {
+		t.Errorf("error loading live session: %v", err)
+	}
+	if err := tbl.Load(&loaded, dead.Id); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+	count := 0
+	for it := tbl.Find().Where(Equals, "bob", "User").Iter(); it.Next(); {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expecting only the live session got %v", count)
+	}
+
+	// opening again should keep the ttl of the table
+	reopened, err := db.Table(tbl.Name())
+	if err != nil || reopened.ttl != time.Hour {
+		t.Errorf("expecting ttl %v got %v: %v", time.Hour, reopened.ttl, err)
+	}
+
+	// tables not created by pgdoc are ignored
+	if _, err := db.db.Exec("create table if not exists ttlforeign (id int, expires_at timestamptz)"); err != nil {
+		t.Fatalf("error creating foreign table: %v", err)
+	}
+	defer db.db.Exec("drop table ttlforeign")
+	// documents that expire on their own are reaped without a TTL
+	tagged, err := db.Table("ttltagdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	gone := session{User: "ann", ExpiresAt: time.Now().Add(-time.Minute)}
+	if _, err := tagged.Save(&gone); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+	if n, err := db.Reap(context.Background()); err != nil || n < 2 {
+		t.Errorf("expecting at least two documents reaped got %v: %v", n, err)
+	}
+	var exists bool
+	for _, s := range []struct{ table, id string }{{"ttldocs", dead.Id}, {"ttltagdocs", gone.Id}} {
+		if err := db.db.QueryRow("select true from "+s.table+" where docid = $1", s.id).Scan(&exists); err != sql.ErrNoRows {
+			t.Errorf("expired document should be deleted from %v, got %v", s.table, err)
+		}
+	}
+
+	// a zero TTL removes the expiration
+	if err := tbl.SetTTL(0); err != nil {
+		t.Fatalf("error removing ttl: %v", err)
+	}
+	if reopened, err = db.Table(tbl.Name()); err != nil || reopened.ttl != 0 {
+		t.Errorf("expecting no ttl got %v: %v", reopened.ttl, err)
+	}
+	var expires *time.Time
+	if err := db.db.QueryRow("select expires_at from ttldocs where docid = $1", live.Id).Scan(&expires); err != nil || expires != nil {
+		t.Errorf("expecting no expiration got %v: %v", expires, err)
+	}
+	if err := tbl.SetTTL(time.Hour); err != nil {
+		t.Fatalf("error restoring ttl: %v", err)
+	}
+}
+
+func TestIndexSpec(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("specdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	for _, name := range []string{"specdocs_age", "specdocs_email"} {
+		db.DropIndex(tbl.Name(), name)
+	}
+
+	err = db.CreateIndexSpec(tbl.Name(), IndexSpec{
+		Name: "specdocs_age",
+		Fields: []IndexField{
+			{Path: []string{"Age"}, Cast: "numeric"},
+			{Path: []string{"Born"}, Cast: "timestamptz"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating composite index: %v", err)
+	}
+	err = db.CreateIndexSpec(tbl.Name(), IndexSpec{
+		Name:         "specdocs_email",
+		Fields:       []IndexField{{Path: []string{"Email"}}},
+		Unique:       true,
+		Where:        []Filter{{Path: []string{"Active"}, Op: Equals, Value: true}},
+		Concurrently: true,
+	})
+	if err != nil {
+		t.Fatalf("error creating partial index: %v", err)
+	}
+	if err := db.CreateIndexSpec(tbl.Name(), IndexSpec{Name: "specdocs_invalid", Fields: []IndexField{{Path: []string{"Age"}, Cast: "int"}}}); err != errInvalidCast {
+		t.Errorf("expecting %v got %v", errInvalidCast, err)
+	}
+
+	indexes, err := db.Indexes(tbl.Name())
+	if err != nil {
+		t.Fatalf("error listing indexes: %v", err)
+	}
+	found := make(map[string]IndexInfo)
+	for _, idx := range indexes {
+		found[idx.Name] = idx
+	}
+	if idx, has := found["specdocs_email"]; !has || !idx.Unique || !idx.Valid || !strings.Contains(idx.Def, "WHERE") {
+		t.Errorf("unexpected partial index: %v", idx)
+	}
+	if idx, has := found["specdocs_age"]; !has || idx.Unique || !strings.Contains(idx.Def, "pgdoc_ts") {
+		t.Errorf("unexpected composite index: %v", idx)
+	}
+
+	type person struct {
+		Id     string
+		Email  string
+		Active bool
+		Age    int
+		Born   time.Time
+	}
+	// inactive documents aren't indexed, so they can repeat the email
+	for _, p := range []person{{Email: "bob@email.com"}, {Email: "bob@email.com"}, {Email: "bob@email.com", Active: true, Born: time.Now()}} {
+		if _, err := tbl.Save(&p); err != nil {
+			t.Errorf("error saving %v: %v", p, err)
+		}
+	}
+	if _, err := tbl.Save(&person{Email: "bob@email.com", Active: true}); err == nil {
+		t.Errorf("partial unique index should reject a second active bob")
+	}
+	it := tbl.Find().Where(Less, time.Now(), "Born").Iter()
+	if !it.Next() || it.Err() != nil {
+		t.Errorf("expecting a document born before now: %v", it.Err())
+	}
+	it.Close()
+}
+
+func TestAggregate(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("aggdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+
+	type sale struct {
+		Id      string
+		Country string
+		Amount  float64
+	}
+	for _, s := range []sale{{Country: "BR", Amount: 10}, {Country: "BR", Amount: 30}, {Country: "US", Amount: 5}} {
+		if _, err := tbl.Save(&s); err != nil {
+			t.Fatalf("error saving: %v", err)
+		}
+	}
+
+	if n, err := tbl.Count(nil); err != nil || n != 3 {
+		t.Errorf("expecting 3 documents got %v: %v", n, err)
+	}
+	if n, err := tbl.Count(tbl.Find().Where(Greater, 6, "Amount")); err != nil || n != 2 {
+		t.Errorf("expecting 2 documents got %v: %v", n, err)
+	}
+
+	type total struct {
+		Country string
+		Sales   int
+		Sum     float64
+		Max     float64
+	}
+	it := tbl.Aggregate(nil).GroupBy("Country", "Country").Count("Sales").Sum("Sum", "Amount").Max("Max", "Amount").Iter()
+	var totals []total
+	for it.Next() {
+		var tt total
+		if err := it.Scan(&tt); err != nil {
+			t.Errorf("error scaning from iterator: %v", err)
+		}
+		totals = append(totals, tt)
+	}
+	if it.Err() != nil {
+		t.Errorf("unexpected error: %v", it.Err())
+	}
+	expected := []total{{"BR", 2, 40, 30}, {"US", 1, 5, 5}}
+	if !reflect.DeepEqual(totals, expected) {
+		t.Errorf("expecting %v got %v", expected, totals)
+	}
+
+	it = tbl.Aggregate(tbl.Find().Where(Equals, "BR", "Country")).Avg("avg", "Amount").Iter()
+	var m map[string]float64
+	if !it.Next() || it.Scan(&m) != nil || m["avg"] != 20 {
+		t.Errorf("expecting avg 20 got %v: %v", m, it.Err())
+	}
+	it.Close()
+
+	if it := tbl.Aggregate(nil).GroupBy("Country", "Country").Iter(); it.Next() || it.Err() != errAggregateWithoutFields {
+		t.Errorf("expecting %v got %v", errAggregateWithoutFields, it.Err())
+	}
+}
+
+func TestTraverse(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	lnk, err := db.Link("traverselinks")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	if err = db.Truncate(lnk.Name()); err != nil {
+		t.Fatalf("error truncating link: %v", err)
+	}
+
+	type edge struct {
+		Id    string
+		From  string
+		To    string
+		Label string
+	}
+	// a -> b -> c -> a and c -> d, d is only reachable by "other"
+	for _, e := range []edge{{"", "a", "b", "child"}, {"", "b", "c", "child"}, {"", "c", "a", "child"}, {"", "c", "d", "other"}} {
+		if _, err := lnk.Connect(&e); err != nil {
+			t.Fatalf("error connecting: %v", err)
+		}
+	}
+
+	steps := func(it Iterator) []Step {
+		var out []Step
+		for it.Next() {
+			var s Step
+			if err := it.Scan(&s); err != nil {
+				t.Errorf("error scaning from iterator: %v", err)
+			}
+			out = append(out, s)
+		}
+		if it.Err() != nil {
+			t.Errorf("unexpected error: %v", it.Err())
+		}
+		return out
+	}
+
+	found := steps(lnk.Traverse("a", Outgoing, []string{"child"}, 0))
+	if len(found) != 3 {
+		t.Fatalf("expecting 3 steps got %v", found)
+	}
+	last := found[2]
+	if last.Id != "a" || !last.Cycle || last.Depth != 3 || !reflect.DeepEqual(last.Path, []string{"a", "b", "c", "a"}) {
+		t.Errorf("unexpected last step: %v", last)
+	}
+
+	if found := steps(lnk.Traverse("a", Outgoing, nil, 2)); len(found) != 2 || found[1].Id != "c" {
+		t.Errorf("expecting a -> b -> c got %v", found)
+	}
+	if found := steps(lnk.Traverse("d", Incoming, nil, 1)); len(found) != 1 || found[0].Id != "c" || found[0].Label != "other" {
+		t.Errorf("expecting d <- c got %v", found)
+	}
+	if found := steps(lnk.Traverse("d", Both, nil, 0)); len(found) < 3 {
+		t.Errorf("expecting every document from d got %v", found)
+	}
+}
+
+func TestBind(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	people, err := db.Table("bindpeople")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	friends, err := db.Link("bindfriends")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	for _, name := range []string{friends.Name(), people.Name()} {
+		if err = db.Truncate(name); err != nil {
+			t.Fatalf("error truncating %v: %v", name, err)
+		}
+	}
+	if err := friends.Bind(people, people, Restrict); err != nil {
+		t.Fatalf("error binding link: %v", err)
+	}
+
+	type person struct {
+		Id string
+	}
+	type friend struct {
+		Id   string
+		From string
+		To   string
+	}
+	bob, ann := person{}, person{}
+	for _, p := range []*person{&bob, &ann} {
+		if _, err := people.Save(p); err != nil {
+			t.Fatalf("error saving: %v", err)
+		}
+	}
+
+	_, err = friends.Connect(&friend{From: bob.Id, To: "nobody"})
+	if de, ok := err.(*DanglingLinkError); !ok || de.Endpoint != "To" || de.Id != "nobody" {
+		t.Errorf("expecting a DanglingLinkError got %v", err)
+	}
+	f := friend{From: bob.Id, To: ann.Id}
+	if _, err := friends.Connect(&f); err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	err = people.Delete(ann.Id)
+	if re, ok := err.(*ReferencedError); !ok || re.Id != ann.Id || re.Link != friends.Name() {
+		t.Errorf("expecting a ReferencedError got %v", err)
+	}
+
+	if err := friends.Bind(people, people, Cascade); err != nil {
+		t.Fatalf("error binding link: %v", err)
+	}
+	if err := people.Delete(ann.Id); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	var loaded friend
+	if err := friends.Load(&loaded, f.Id); err != sql.ErrNoRows {
+		t.Errorf("link should be removed with the document, got %v", err)
+	}
+
+	nullable := func() string {
+		var null string
+		err := db.db.QueryRow("select is_nullable from information_schema.columns where table_name = $1 and column_name = '_to'", friends.Name()).Scan(&null)
+		if err != nil {
+			t.Fatalf("error reading the column: %v", err)
+		}
+		return null
+	}
+	if err := friends.Bind(people, people, Nullify); err != nil {
+		t.Fatalf("error binding link: %v", err)
+	}
+	if null := nullable(); null != "YES" {
+		t.Errorf("endpoint should be nullable got %v", null)
+	}
+	if err := friends.Bind(people, people, Cascade); err != nil {
+		t.Fatalf("error binding link: %v", err)
+	}
+	if null := nullable(); null != "NO" {
+		t.Errorf("endpoint should be not null after binding again got %v", null)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Dump(buf, friends.Name()); err != nil {
+		t.Fatalf("error dumping: %v", err)
+	}
+	if err := friends.Unbind(); err != nil {
+		t.Fatalf("error removing constraints: %v", err)
+	}
+	if err := db.Restore(buf); err != nil {
+		t.Fatalf("error restoring: %v", err)
+	}
+	from, to, onDelete, err := binding(context.Background(), db.db, friends.Name())
+	if err != nil || from == nil || *from != people.Name() || to == nil || *to != people.Name() || onDelete != Cascade {
+		t.Errorf("restore should bind the link to %v with %v got %v, %v, %v: %v", people.Name(), Cascade, from, to, onDelete, err)
+	}
+	if err := friends.Unbind(); err != nil {
+		t.Errorf("error removing constraints: %v", err)
+	}
+}
+
+func TestDumpNullified(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	people, err := db.Table("nullpeople")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	friends, err := db.Link("nullfriends")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	for _, name := range []string{friends.Name(), people.Name()} {
+		if err = db.Truncate(name); err != nil {
+			t.Fatalf("error truncating %v: %v", name, err)
+		}
+	}
+	if err := friends.Bind(people, people, Nullify); err != nil {
+		t.Fatalf("error binding link: %v", err)
+	}
+	defer friends.Unbind()
+
+	type person struct {
+		Id string
+	}
+	type friend struct {
+		Id   string
+		From string
+		To   string
+	}
+	bob, ann := person{}, person{}
+	for _, p := range []*person{&bob, &ann} {
+		if _, err := people.Save(p); err != nil {
+			t.Fatalf("error saving: %v", err)
+		}
+	}
+	f := friend{From: bob.Id, To: ann.Id}
+	if _, err := friends.Connect(&f); err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	if err := people.Delete(ann.Id); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Dump(buf, friends.Name()); err != nil {
+		t.Fatalf("error dumping: %v", err)
+	}
+	if err := db.Truncate(friends.Name()); err != nil {
+		t.Fatalf("error truncating: %v", err)
+	}
+	if err := db.Restore(buf); err != nil {
+		t.Fatalf("error restoring: %v", err)
+	}
+	var from string
+	var to sql.NullString
+	err = db.db.QueryRow("select _from, _to from "+friends.Name()+" where linkid = $1", f.Id).Scan(&from, &to)
+	if err != nil || from != bob.Id || to.Valid {
+		t.Errorf("expecting the link from %v to null got %v, %v: %v", bob.Id, from, to.String, err)
+	}
+}
+
+func TestMultiplicity(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	lnk, err := db.Link("multilinks")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	if err = db.Truncate(lnk.Name()); err != nil {
+		t.Fatalf("error truncating link: %v", err)
+	}
+	if err := lnk.Constrain("manager", ManyToOne); err != nil {
+		t.Fatalf("error constraining manager: %v", err)
+	}
+	if err := lnk.Constrain("friend", UniquePair); err != nil {
+		t.Fatalf("error constraining friend: %v", err)
+	}
+	if m, err := lnk.Multiplicity("friend"); err != nil || m != UniquePair {
+		t.Errorf("expecting %v got %v: %v", UniquePair, m, err)
+	}
+
+	type edge struct {
+		Id    string
+		From  string
+		To    string
+		Label string
+	}
+	for _, e := range []edge{{"", "bob", "ann", "manager"}, {"", "bob", "ann", "friend"}, {"", "bob", "tom", "friend"}} {
+		if _, err := lnk.Connect(&e); err != nil {
+			t.Fatalf("error connecting %v: %v", e, err)
+		}
+	}
+
+	_, err = lnk.Connect(&edge{From: "bob", To: "tom", Label: "manager"})
+	if ce, ok := err.(*LinkConstraintError); !ok || ce.Multiplicity != ManyToOne || ce.Label != "manager" {
+		t.Errorf("expecting a LinkConstraintError got %v", err)
+	}
+	err = lnk.ConnectMany([]edge{{From: "ann", To: "bob", Label: "friend"}, {From: "bob", To: "ann", Label: "friend"}})
+	if be, ok := err.(*BulkError); !ok || len(be.Rows) != 1 || be.Rows[0].Index != 1 {
+		t.Errorf("expecting the second row to fail got %v", err)
+	} else if _, ok := be.Rows[0].Err.(*LinkConstraintError); !ok {
+		t.Errorf("expecting a LinkConstraintError got %v", be.Rows[0].Err)
+	}
+
+	if err := lnk.RemoveConstraint("manager"); err != nil {
+		t.Fatalf("error removing constraint: %v", err)
+	}
+	if _, err := lnk.Connect(&edge{From: "bob", To: "tom", Label: "manager"}); err != nil {
+		t.Errorf("constraint should be removed: %v", err)
+	}
+}
+
+func TestPage(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("pagedocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+
+	type item struct {
+		Id   string
+		Name string `json:",omitempty"`
+	}
+	items := []*item{{Name: "a"}, {Name: "b"}, {Name: "b"}, {}, {Name: "c"}}
+	if err := tbl.SaveMany(items); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+
+	readAll := func(q *Query) []string {
+		var names []string
+		token := ""
+		for {
+			var page []item
+			next, err := q.Page(token, 2, &page)
+			if err != nil {
+				t.Fatalf("error reading page: %v", err)
+			}
+			if len(page) > 2 {
+				t.Errorf("page bigger than 2: %v", page)
+			}
+			for _, i := range page {
+				names = append(names, i.Name)
+			}
+			if len(next) == 0 {
+				return names
+			}
+			token = next
+		}
+	}
+	if got := readAll(tbl.Find().OrderBy("Name")); !reflect.DeepEqual(got, []string{"a", "b", "b", "c", ""}) {
+		t.Errorf("expecting [a b b c ] got %v", got)
+	}
+	if got := readAll(tbl.Find().OrderByDesc("Name")); !reflect.DeepEqual(got, []string{"", "c", "b", "b", "a"}) {
+		t.Errorf("expecting [ c b b a] got %v", got)
+	}
+	if got := readAll(tbl.Find().Where(NotEqual, "a", "Name")); len(got) != 3 {
+		t.Errorf("expecting 3 documents got %v", got)
+	}
+
+	var page []item
+	if _, err := tbl.Find().OrderBy("Name").Page("", 0, &page); err != errInvalidPageSize {
+		t.Errorf("expecting %v got %v", errInvalidPageSize, err)
+	}
+	next, _ := tbl.Find().OrderBy("Name").Page("", 1, &page)
+	if _, err := tbl.Find().Page(next, 1, &page); err != errInvalidPageToken {
+		t.Errorf("expecting %v got %v", errInvalidPageToken, err)
+	}
+
+	lnk, err := db.Link("pagelinks")
+	if err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	if err = db.Truncate(lnk.Name()); err != nil {
+		t.Fatalf("error truncating link: %v", err)
+	}
+	type edge struct {
+		Id    string
+		From  string
+		To    string
+		Label string
+	}
+	for _, to := range []string{"b", "c", "d"} {
+		if _, err := lnk.Connect(&edge{From: "a", To: to, Label: "knows"}); err != nil {
+			t.Fatalf("error connecting: %v", err)
+		}
+	}
+	var edges []edge
+	next, err = lnk.LoadPage("a", "", "knows", "", 2, &edges)
+	if err != nil || len(edges) != 2 || len(next) == 0 {
+		t.Fatalf("expecting 2 links and a next page got %v %q: %v", edges, next, err)
+	}
+	next, err = lnk.LoadPage("a", "", "knows", next, 2, &edges)
+	if err != nil || len(edges) != 1 || len(next) != 0 {
+		t.Errorf("expecting the last link got %v %q: %v", edges, next, err)
+	}
+
+	it := tbl.Find().OrderBy("Name").Iter()
+	var all []item
+	if err := it.ScanAll(&all); err != nil || len(all) != 5 {
+		t.Errorf("expecting 5 documents got %v: %v", all, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("migratedocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	if err = db.deleteMeta(tbl.Name(), migrationsMeta); err != nil {
+		t.Fatalf("error removing migration state: %v", err)
+	}
+
+	type v0 struct {
+		Id   string
+		Name string
+	}
+	var docs []*v0
+	for i := 0; i < migrateBatch+10; i++ {
+		docs = append(docs, &v0{Name: fmt.Sprintf("first %v", i)})
+	}
+	if err := tbl.SaveMany(docs); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+
+	// v1 splits the name, v2 adds a counter
+	db.RegisterMigration(tbl.Name(), 2, func(doc map[string]interface{}) error {
+		if _, ok := doc["Count"]; !ok {
+			doc["Count"] = 0
+		}
+		return nil
+	})
+	db.RegisterMigration(tbl.Name(), 1, func(doc map[string]interface{}) error {
+		if name, ok := doc["Name"].(string); ok {
+			parts := strings.SplitN(name, " ", 2)
+			doc["First"], doc["Last"] = parts[0], parts[1]
+			delete(doc, "Name")
+		}
+		return nil
+	})
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+	if v, err := db.MigrationVersion(tbl.Name()); err != nil || v != 2 {
+		t.Errorf("expecting version 2 got %v: %v", v, err)
+	}
+
+	type v2 struct {
+		Id    string
+		Rev   int64
+		First string
+		Last  string
+		Count int
+	}
+	var loaded v2
+	if err := tbl.Load(&loaded, docs[migrateBatch].Id); err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	expected := v2{Id: docs[migrateBatch].Id, Rev: 3, First: "first", Last: fmt.Sprintf("%v", migrateBatch)}
+	if loaded != expected {
+		t.Errorf("expecting %v got %v", expected, loaded)
+	}
+
+	// nothing left to apply, so the documents are not changed
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("error migrating again: %v", err)
+	}
+	if err := tbl.Load(&loaded, docs[0].Id); err != nil || loaded.Rev != 3 {
+		t.Errorf("expecting rev 3 got %v: %v", loaded.Rev, err)
+	}
+
+	failing := errors.New("failed")
+	db.RegisterMigration(tbl.Name(), 3, func(doc map[string]interface{}) error { return failing })
+	if err := db.Migrate(context.Background()); err == nil {
+		t.Errorf("migration error should be returned")
+	}
+	if v, err := db.MigrationVersion(tbl.Name()); err != nil || v != 2 {
+		t.Errorf("failed migration should keep version 2 got %v: %v", v, err)
+	}
+}
+
+func TestMigrateRevision(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	tbl, err := db.Table("migraterevdocs")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	if err = db.Truncate(tbl.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	if err = db.deleteMeta(tbl.Name(), migrationsMeta); err != nil {
+		t.Fatalf("error removing migration state: %v", err)
+	}
+
+	type doc struct {
+		Id    string
+		Rev   int64
+		Name  string
+		Count int
+	}
+	bob := doc{Name: "Bob"}
+	if _, err := tbl.Save(&bob); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	db.RegisterMigration(tbl.Name(), 5, func(doc map[string]interface{}) error {
+		doc["Count"] = 5
+		return nil
+	})
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+
+	// Find only reads the body, which must carry the new revision
+	var found []doc
+	if err := tbl.Find().Where(Equals, bob.Id, "Id").Iter().ScanAll(&found); err != nil || len(found) != 1 || found[0].Rev != 2 {
+		t.Fatalf("expecting bob at rev 2 got %v: %v", found, err)
+	}
+	if _, err := tbl.Save(&found[0]); err != nil {
+		t.Errorf("error saving a migrated document: %v", err)
+	}
+
+	// a lower version registered later still runs
+	db.RegisterMigration(tbl.Name(), 3, func(doc map[string]interface{}) error {
+		doc["Name"] = "Robert"
+		return nil
+	})
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+	var loaded doc
+	if err := tbl.Load(&loaded, bob.Id); err != nil || loaded.Name != "Robert" || loaded.Count != 5 {
+		t.Errorf("expecting both migrations applied got %v: %v", loaded, err)
+	}
+	if v, err := db.MigrationVersion(tbl.Name()); err != nil || v != 5 {
+		t.Errorf("expecting version 5 got %v: %v", v, err)
+	}
+}
+
+func TestCollection(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	type user struct {
+		Key   string `pgdoc:"id"`
+		Rev   int64
+		Email string `json:"email" pgdoc:"unique"`
+		Age   int    `pgdoc:"index"`
+	}
+	users, err := NewCollection[user](db, "userdocs")
+	if err != nil {
+		t.Fatalf("error creating collection: %v", err)
+	}
+	if err = db.Truncate(users.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+	// opening again don't fail because the indexes exist
+	if _, err := NewCollection[user](db, "userdocs"); err != nil {
+		t.Fatalf("error opening collection again: %v", err)
+	}
+	indexes, err := db.Indexes(users.Name())
+	if err != nil {
+		t.Fatalf("error listing indexes: %v", err)
+	}
+	found := map[string]bool{}
+	for _, i := range indexes {
+		found[i.Name] = i.Unique
+	}
+	if unique, ok := found["email"]; !ok || !unique {
+		t.Errorf("expecting unique index email got %v", indexes)
+	}
+	if unique, ok := found["age"]; !ok || unique {
+		t.Errorf("expecting index age got %v", indexes)
+	}
+
+	bob := user{Email: "bob@example.com", Age: 30}
+	id, err := users.Save(&bob)
+	if err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	if bob.Key != id || bob.Rev != 1 {
+		t.Errorf("expecting key %v and rev 1 got %v", id, bob)
+	}
+	if _, err := users.Save(&user{Email: "bob@example.com"}); err == nil {
+		t.Errorf("unique index should reject the same email")
+	}
+
+	bob.Age = 31
+	if _, err := users.Save(&bob); err != nil {
+		t.Fatalf("error updating: %v", err)
+	}
+	loaded, err := users.Load(id)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if loaded != bob {
+		t.Errorf("expecting %v got %v", bob, loaded)
+	}
+
+	ann := user{Key: "ann", Email: "ann@example.com", Age: 40}
+	if _, err := users.Save(&ann); err != nil {
+		t.Fatalf("error saving ann: %v", err)
+	}
+	all, err := users.All(users.Find().OrderBy("email"))
+	if err != nil || len(all) != 2 || all[0].Key != "ann" {
+		t.Errorf("expecting ann and bob got %v: %v", all, err)
+	}
+	page, next, err := users.Page(users.Find().Where(Greater, 35, "Age"), "", 10)
+	if err != nil || len(page) != 1 || page[0].Key != "ann" || len(next) != 0 {
+		t.Errorf("expecting only ann got %v %q: %v", page, next, err)
+	}
+
+	if err := users.Delete("ann"); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	if _, err := users.Load("ann"); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+}
+
+// xorKeys is a KeyProvider for the tests, don't use it for real data
+type xorKeys struct{}
+
+func (xorKeys) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	out := make([]byte, len(key))
+	for i := range key {
+		out[i] = key[i] ^ 0x5c
+	}
+	return out, nil
+}
+
+func (x xorKeys) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return x.WrapKey(ctx, wrapped)
+}
+
+func TestEncrypt(t *testing.T) {
+	db := mustOpenDb(t)
+	defer db.Close()
+
+	type customer struct {
+		Id    string
+		Name  string
+		Email string `pgdoc:"encrypt,deterministic,unique"`
+		Phone string `pgdoc:"encrypt"`
+	}
+	customers, err := NewCollection[customer](db, "cryptdocs")
+	if err != nil {
+		t.Fatalf("error creating collection: %v", err)
+	}
+	if err = db.Truncate(customers.Name()); err != nil {
+		t.Fatalf("error truncating table: %v", err)
+	}
+
+	bob := customer{Name: "Bob", Email: "bob@example.com", Phone: "555-1234"}
+	if _, err := customers.Save(&bob); err != ErrNoKeyProvider {
+		t.Errorf("expecting %v got %v", ErrNoKeyProvider, err)
+	}
+	db.SetKeyProvider(xorKeys{})
+	id, err := customers.Save(&bob)
+	if err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+
+	var raw string
+	if err := db.DB().QueryRow("select body from cryptdocs where docid = $1", id).Scan(&raw); err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	if strings.Contains(raw, "bob@example.com") || strings.Contains(raw, "555-1234") || !strings.Contains(raw, "Bob") {
+		t.Errorf("only tagged fields should be encrypted: %v", raw)
+	}
+
+	loaded, err := customers.Load(id)
+	if err != nil || loaded != bob {
+		t.Errorf("expecting %v got %v: %v", bob, loaded, err)
+	}
+
+	if _, err := customers.Save(&customer{Name: "Other Bob", Email: "bob@example.com"}); err == nil {
+		t.Errorf("unique index should reject the same encrypted email")
+	}
+	email, err := db.EncryptValue("bob@example.com")
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+	found, err := customers.All(customers.Find().Where(Equals, email, "Email"))
+	if err != nil || len(found) != 1 || found[0] != bob {
+		t.Errorf("expecting bob got %v: %v", found, err)
+	}
+
+	var patched customer
+	if err := customers.Table().Patch(&patched, id, map[string]string{"Phone": "555-0000"}); err != errPatchEncrypted {
+		t.Errorf("expecting %v got %v", errPatchEncrypted, err)
+	}
+	if err := customers.Table().Patch(&patched, id, map[string]string{"Name": "Robert"}); err != nil || patched.Name != "Robert" || patched.Phone != bob.Phone {
+		t.Errorf("expecting a patched name got %v: %v", patched, err)
+	}
+	bob.Name = "Robert"
+
+	// a new process uses the data key saved in the metadata table
+	other := mustOpenDb(t)
+	defer other.Close()
+	other.SetKeyProvider(xorKeys{})
+	var again customer
+	tbl, _ := other.Table("cryptdocs")
+	if err := tbl.Load(&again, id); err != nil || again != bob {
+		t.Errorf("expecting %v got %v: %v", bob, again, err)
+	}
+
+	// dumps carry the data key, but can't replace it
+	buf := &bytes.Buffer{}
+	if err := db.Dump(buf, customers.Name()); err != nil {
+		t.Fatalf("error dumping: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"kind":"datakey"`) {
+		t.Errorf("dump should start with the data key: %v", buf.String())
+	}
+	dump := buf.String()
+	if err := db.Restore(strings.NewReader(dump)); err != nil {
+		t.Errorf("error restoring with the same key: %v", err)
+	}
+	line := dump[:strings.Index(dump, "\n")]
+	otherKey := `{"kind":"datakey","name":"","body":"b3RoZXIga2V5"}`
+	if err := db.Restore(strings.NewReader(strings.Replace(dump, line, otherKey, 1))); err != errDataKeyMismatch {
+		t.Errorf("expecting %v got %v", errDataKeyMismatch, err)
+	}
+}
+
+func TestTableInTransaction(t *testing.T) {
+	// with a single connection, anything done outside of the
+	// transaction would wait forever
+	db, err := Open(Options{User: "graph", Password: "graph", Database: "graph", Host: "localhost", MaxOpenConns: 1})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.Transaction(func(tx *Tx) error {
+		tbl, err := tx.TableWithOptions("txttldocs", TableOptions{TTL: time.Hour})
+		if err != nil {
+			return err
+		}
+		if tbl.ttl != time.Hour {
+			t.Errorf("expecting ttl %v got %v", time.Hour, tbl.ttl)
+		}
+		_, err = tbl.Save(&struct{ Id string }{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error inside transaction: %v", err)
+	}
+	if tbl, err := db.Table("txttldocs"); err != nil || tbl.ttl != time.Hour {
+		t.Errorf("expecting ttl %v after commit got %v: %v", time.Hour, tbl, err)
+	}
+}
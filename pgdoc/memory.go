@@ -0,0 +1,913 @@
+package pgdoc
+
+import (
+	"amoraes.info/pgdoc/reflector"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryStore implements Store keeping everything in memory, it
+	// is meant to be used by tests that don't have access to a
+	// postgresql server.
+	//
+	// Documents are stored as json, so they behave like the ones
+	// saved in a Database: ids, revisions, unique indexes, cascades
+	// and queries work the same way.
+	MemoryStore struct {
+		reflector reflector.R
+
+		mu      sync.RWMutex
+		data    map[string]*memCollection
+		cascade map[string][]string
+		ids     IDGenerator
+	}
+
+	memCollection struct {
+		docs    map[string]*memDoc
+		indexes map[string]memIndex
+	}
+
+	memDoc struct {
+		id   string
+		rev  int64
+		body []byte
+		// body decoded, used by filters
+		doc interface{}
+		// only used by links
+		from  string
+		to    string
+		label string
+	}
+
+	memIndex struct {
+		unique bool
+		path   []string
+	}
+
+	memTable struct {
+		name  string
+		owner *MemoryStore
+	}
+
+	memLink struct {
+		name  string
+		owner *MemoryStore
+	}
+
+	memIter struct {
+		bodies    [][]byte
+		pos       int
+		reflector *reflector.R
+	}
+)
+
+var (
+	_ Store      = (*MemoryStore)(nil)
+	_ TableStore = (*memTable)(nil)
+	_ LinkStore  = (*memLink)(nil)
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:    make(map[string]*memCollection),
+		cascade: make(map[string][]string),
+	}
+}
+
+func (m *MemoryStore) OpenTable(name string) (TableStore, error) {
+	m.ensure(name)
+	return &memTable{name, m}, nil
+}
+
+func (m *MemoryStore) OpenLink(name string) (LinkStore, error) {
+	m.ensure(name)
+	return &memLink{name, m}, nil
+}
+
+func (m *MemoryStore) ensure(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, has := m.data[name]; !has {
+		m.data[name] = &memCollection{
+			docs:    make(map[string]*memDoc),
+			indexes: make(map[string]memIndex),
+		}
+	}
+}
+
+func (m *MemoryStore) collection(name string) (*memCollection, error) {
+	c, has := m.data[name]
+	if !has {
+		return nil, fmt.Errorf("relation %v does not exist", name)
+	}
+	return c, nil
+}
+
+func (m *MemoryStore) Unique(tableOrLink string, idxName string, propPath ...string) error {
+	if len(propPath) == 0 {
+		return errUniqueWithoutPath
+	}
+	return m.createIndex(tableOrLink, idxName, memIndex{true, propPath})
+}
+
+func (m *MemoryStore) CreateIndex(tableOrLink string, idxName string, propPath ...string) error {
+	return m.createIndex(tableOrLink, idxName, memIndex{false, propPath})
+}
+
+func (m *MemoryStore) createIndex(tableOrLink string, idxName string, idx memIndex) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.collection(tableOrLink)
+	if err != nil {
+		return err
+	}
+	if _, has := c.indexes[idxName]; has {
+		return ErrIndexAlreadyExists
+	}
+	if idx.unique {
+		seen := make(map[string]bool)
+		for _, d := range c.docs {
+			if v, ok := textValue(d.doc, idx.path); ok {
+				if seen[v] {
+					return fmt.Errorf("could not create unique index %v, key %v is duplicated", idxName, v)
+				}
+				seen[v] = true
+			}
+		}
+	}
+	c.indexes[idxName] = idx
+	return nil
+}
+
+func (m *MemoryStore) DropIndex(tableOrLink string, idxName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.collection(tableOrLink)
+	if err != nil {
+		return err
+	}
+	if _, has := c.indexes[idxName]; !has {
+		return fmt.Errorf("index %v does not exist", idxName)
+	}
+	delete(c.indexes, idxName)
+	return nil
+}
+
+func (m *MemoryStore) CascadeLinks(table string, links ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range links {
+		if !contains(m.cascade[table], l) {
+			m.cascade[table] = append(m.cascade[table], l)
+		}
+	}
+}
+
+func (m *MemoryStore) SetIDGenerator(g IDGenerator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ids = g
+}
+
+func (m *MemoryStore) Truncate(tblOrLink string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.collection(tblOrLink)
+	if err != nil {
+		return err
+	}
+	c.docs = make(map[string]*memDoc)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// newId MUST be called with the lock held
+func (m *MemoryStore) newId(prefix string) (string, error) {
+	g := m.ids
+	if g == nil {
+		g = defaultIds
+	}
+	return g.NewID(prefix)
+}
+
+// put stores the document after checking the unique indexes, MUST be
+// called with the lock held
+func (m *MemoryStore) put(name string, d *memDoc) error {
+	c, err := m.collection(name)
+	if err != nil {
+		return err
+	}
+	for idxName, idx := range c.indexes {
+		if !idx.unique {
+			continue
+		}
+		v, ok := textValue(d.doc, idx.path)
+		if !ok {
+			continue
+		}
+		for _, other := range c.docs {
+			if other.id == d.id {
+				continue
+			}
+			if ov, ok := textValue(other.doc, idx.path); ok && ov == v {
+				return fmt.Errorf("duplicate key value violates unique index %v", idxName)
+			}
+		}
+	}
+	c.docs[d.id] = d
+	return nil
+}
+
+// sorted returns the documents in the collection, sorted by id
+func (m *MemoryStore) sorted(name string) ([]*memDoc, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, err := m.collection(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*memDoc, 0, len(c.docs))
+	for _, d := range c.docs {
+		out = append(out, d)
+	}
+	sort.Sort(memDocsById(out))
+	return out, nil
+}
+
+func (m *MemoryStore) load(name string, out interface{}, id string) error {
+	if !m.reflector.IsPtr(out) {
+		return errValNotAPointer
+	}
+	m.mu.RLock()
+	c, err := m.collection(name)
+	var d *memDoc
+	if err == nil {
+		d = c.docs[id]
+	}
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return sql.ErrNoRows
+	}
+	if err := (jsonCol{out, nil}).Scan(d.body); err != nil {
+		return err
+	}
+	m.reflector.SetFieldOrTag(out, "Rev", revTag, d.rev)
+	return nil
+}
+
+// remove deletes the documents that match the filters and the links
+// that point to them, returns how many documents were removed
+func (m *MemoryStore) remove(name string, match func(d *memDoc) (bool, error)) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.collection(name)
+	if err != nil {
+		return 0, err
+	}
+	// everything that can fail is done before changing anything, so
+	// a failure leaves the store as it was, like a transaction
+	deleted := make(map[string]bool)
+	for id, d := range c.docs {
+		ok, err := match(d)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			deleted[id] = true
+		}
+	}
+	links := make([]*memCollection, 0, len(m.cascade[name]))
+	for _, lname := range m.cascade[name] {
+		lc, err := m.collection(lname)
+		if err != nil {
+			return 0, err
+		}
+		links = append(links, lc)
+	}
+	for id := range deleted {
+		delete(c.docs, id)
+	}
+	for _, lc := range links {
+		for id, d := range lc.docs {
+			if deleted[d.from] || deleted[d.to] {
+				delete(lc.docs, id)
+			}
+		}
+	}
+	return int64(len(deleted)), nil
+}
+
+func (t *memTable) Name() string {
+	return t.name
+}
+
+func (t *memTable) Load(out interface{}, id string) error {
+	return t.LoadContext(context.Background(), out, id)
+}
+
+func (t *memTable) LoadContext(ctx context.Context, out interface{}, id string) error {
+	return t.owner.load(t.name, out, id)
+}
+
+func (t *memTable) Save(val interface{}) (string, error) {
+	return t.SaveContext(context.Background(), val)
+}
+
+func (t *memTable) SaveContext(ctx context.Context, val interface{}) (string, error) {
+	return t.save(val, true)
+}
+
+func (t *memTable) save(val interface{}, allowUpdate bool) (string, error) {
+	r := &t.owner.reflector
+	if !r.IsPtr(val) {
+		return "", errValNotAPointer
+	}
+	var id string
+	if r.HasField(val, "Id") {
+		id = r.GetField(val, "Id", "").(string)
+	}
+
+	t.owner.mu.Lock()
+	defer t.owner.mu.Unlock()
+	c, err := t.owner.collection(t.name)
+	if err != nil {
+		return "", err
+	}
+	if len(id) == 0 {
+		if id, err = t.owner.newId(t.name); err != nil {
+			return "", err
+		}
+	}
+	rev := int64(1)
+	if prev, exists := c.docs[id]; exists {
+		if !allowUpdate {
+			return "", fmt.Errorf("duplicate key value violates primary key of %v", t.name)
+		}
+		if cur, hasRev := revOf(r, val); hasRev && cur != prev.rev {
+			return "", ErrConflict
+		}
+		rev = prev.rev + 1
+	}
+
+	oldRev, _ := revOf(r, val)
+	if r.HasField(val, "Id") {
+		r.SetField(val, "Id", id)
+	}
+	r.SetFieldOrTag(val, "Rev", revTag, rev)
+	d, err := newMemDoc(id, val)
+	if err == nil {
+		d.rev = rev
+		err = t.owner.put(t.name, d)
+	}
+	if err != nil {
+		r.SetFieldOrTag(val, "Rev", revTag, oldRev)
+		return "", err
+	}
+	return id, nil
+}
+
+func (t *memTable) SaveMany(docs interface{}) error {
+	vals, ok := t.owner.reflector.Elems(docs)
+	if !ok {
+		return errValNotASlice
+	}
+	var failed []RowError
+	for i, val := range vals {
+		if _, err := t.save(val, false); err != nil {
+			failed = append(failed, RowError{i, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &BulkError{failed}
+	}
+	return nil
+}
+
+func (t *memTable) Delete(id string) error {
+	return t.DeleteContext(context.Background(), id)
+}
+
+func (t *memTable) DeleteContext(ctx context.Context, id string) error {
+	_, err := t.owner.remove(t.name, func(d *memDoc) (bool, error) {
+		return d.id == id, nil
+	})
+	return err
+}
+
+func (t *memTable) DeleteWhere(q *Query) (int64, error) {
+	if q == nil || len(q.filter) == 0 {
+		return 0, errAtLeastOneParameter
+	}
+	if _, err := q.writeFilter(&bytes.Buffer{}, nil); err != nil {
+		return 0, err
+	}
+	return t.owner.remove(t.name, func(d *memDoc) (bool, error) {
+		return q.match(d.doc)
+	})
+}
+
+func (t *memTable) Find() *Query {
+	return &Query{runner: t}
+}
+
+func (t *memTable) Contains(fragment interface{}) Iterator {
+	return t.Find().Where(Contains, fragment).Iter()
+}
+
+func (t *memTable) runQuery(ctx context.Context, q *Query) Iterator {
+	// report invalid filters like a Table, even if no document is
+	// evaluated
+	if _, err := q.writeFilter(&bytes.Buffer{}, nil); err != nil {
+		return errIter{err}
+	}
+	docs, err := t.owner.sorted(t.name)
+	if err != nil {
+		return errIter{err}
+	}
+	var found []*memDoc
+	for _, d := range docs {
+		ok, err := q.match(d.doc)
+		if err != nil {
+			return errIter{err}
+		}
+		if ok {
+			found = append(found, d)
+		}
+	}
+	if len(q.order) > 0 {
+		sort.Stable(memDocsByOrder{found, q.order})
+	}
+	if q.offset > 0 {
+		if q.offset > len(found) {
+			found = nil
+		} else {
+			found = found[q.offset:]
+		}
+	}
+	if q.limit > 0 && q.limit < len(found) {
+		found = found[:q.limit]
+	}
+	return newMemIter(found, &t.owner.reflector)
+}
+
+func (l *memLink) Name() string {
+	return l.name
+}
+
+func (l *memLink) Load(out interface{}, id string) error {
+	return l.LoadContext(context.Background(), out, id)
+}
+
+func (l *memLink) LoadContext(ctx context.Context, out interface{}, id string) error {
+	return l.owner.load(l.name, out, id)
+}
+
+func (l *memLink) From(from string) Iterator {
+	return l.LoadMany(from, "", "")
+}
+
+func (l *memLink) To(to string) Iterator {
+	return l.LoadMany("", to, "")
+}
+
+func (l *memLink) Label(label string) Iterator {
+	return l.LoadMany("", "", label)
+}
+
+func (l *memLink) LoadMany(from, to, label string) Iterator {
+	return l.LoadManyContext(context.Background(), from, to, label)
+}
+
+func (l *memLink) LoadManyContext(ctx context.Context, from, to, label string) Iterator {
+	if len(from) == 0 && len(to) == 0 && len(label) == 0 {
+		return errIter{errAtLeastOneParameter}
+	}
+	docs, err := l.owner.sorted(l.name)
+	if err != nil {
+		return errIter{err}
+	}
+	var found []*memDoc
+	for _, d := range docs {
+		if (len(from) == 0 || d.from == from) &&
+			(len(to) == 0 || d.to == to) &&
+			(len(label) == 0 || d.label == label) {
+			found = append(found, d)
+		}
+	}
+	return newMemIter(found, &l.owner.reflector)
+}
+
+func (l *memLink) Connect(val interface{}) (string, error) {
+	return l.ConnectContext(context.Background(), val)
+}
+
+func (l *memLink) ConnectContext(ctx context.Context, val interface{}) (string, error) {
+	return l.connect(val)
+}
+
+func (l *memLink) connect(val interface{}) (string, error) {
+	r := &l.owner.reflector
+	if !r.IsPtr(val) {
+		return "", errValNotAPointer
+	}
+	id := r.GetFieldOrTag(val, "Id", `pgdoc:"Id"`, "").(string)
+	from, to, label, err := linkEndpoints(r, val)
+	if err != nil {
+		return "", err
+	}
+
+	l.owner.mu.Lock()
+	defer l.owner.mu.Unlock()
+	if len(id) == 0 {
+		if id, err = l.owner.newId(l.name); err != nil {
+			return "", err
+		}
+		r.SetFieldOrTag(val, "Id", `pgdoc:"Id"`, id)
+	}
+	d, err := newMemDoc(id, val)
+	if err != nil {
+		return "", err
+	}
+	d.rev, d.from, d.to, d.label = 1, from, to, label
+	return id, l.owner.put(l.name, d)
+}
+
+func (l *memLink) ConnectMany(edges interface{}) error {
+	vals, ok := l.owner.reflector.Elems(edges)
+	if !ok {
+		return errValNotASlice
+	}
+	var failed []RowError
+	for i, val := range vals {
+		if _, err := l.connect(val); err != nil {
+			failed = append(failed, RowError{i, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &BulkError{failed}
+	}
+	return nil
+}
+
+func newMemDoc(id string, val interface{}) (*memDoc, error) {
+	body := []byte(jsonCol{val, nil}.plain())
+	doc, err := decodeDoc(body)
+	if err != nil {
+		return nil, err
+	}
+	return &memDoc{id: id, body: body, doc: doc}, nil
+}
+
+func decodeDoc(body []byte) (interface{}, error) {
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return normalize(doc), nil
+}
+
+func newMemIter(docs []*memDoc, r *reflector.R) Iterator {
+	bodies := make([][]byte, len(docs))
+	for i, d := range docs {
+		bodies[i] = d.body
+	}
+	return &memIter{bodies: bodies, reflector: r}
+}
+
+func (m *memIter) Next() bool {
+	if m.pos >= len(m.bodies) {
+		return false
+	}
+	m.pos++
+	return true
+}
+
+func (m *memIter) Scan(out interface{}) error {
+	if !m.reflector.IsPtr(out) {
+		return errValNotAPointer
+	}
+	if m.pos == 0 || m.pos > len(m.bodies) {
+		return sql.ErrNoRows
+	}
+	return jsonCol{out, nil}.Scan(m.bodies[m.pos-1])
+}
+
+func (m *memIter) ScanAll(out interface{}) error {
+	return scanAll(m, m.reflector, out)
+}
+
+func (m *memIter) Err() error   { return nil }
+func (m *memIter) Close() error { m.pos = len(m.bodies); return nil }
+
+// match evaluates the filters of the query in memory, following the
+// semantics of the queries executed by postgresql
+func (q *Query) match(doc interface{}) (bool, error) {
+	for _, f := range q.filter {
+		ok, err := f.match(doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (f *Filter) match(doc interface{}) (bool, error) {
+	if f.Op == Contains {
+		frag, err := decodeDoc([]byte(fragmentString(f.Value)))
+		if err != nil {
+			return false, err
+		}
+		target, ok := jsonValue(doc, f.Path)
+		return ok && containsJSON(target, frag), nil
+	}
+	if len(f.Path) == 0 {
+		return false, errEmptyPath
+	}
+	switch f.Op {
+	case Exists:
+		_, ok := jsonValue(doc, f.Path)
+		return ok, nil
+	case Like:
+		pattern, ok := f.Value.(string)
+		if !ok {
+			return false, errLikeNeedsString
+		}
+		text, ok := textValue(doc, f.Path)
+		return ok && likeRegexp(pattern).MatchString(text), nil
+	case In:
+		rval := reflect.ValueOf(f.Value)
+		if rval.Kind() != reflect.Slice {
+			return false, errInNeedsSlice
+		}
+		for i := 0; i < rval.Len(); i++ {
+			eq := Filter{f.Path, Equals, rval.Index(i).Interface()}
+			if ok, err := eq.match(doc); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case Equals, NotEqual, Greater, Less, GreaterEquals, LessEquals:
+		text, ok := textValue(doc, f.Path)
+		if !ok {
+			// null is never equal (or different) to anything
+			return false, nil
+		}
+		cmp, err := compareText(text, f.Value)
+		if err != nil {
+			return false, err
+		}
+		switch f.Op {
+		case Equals:
+			return cmp == 0, nil
+		case NotEqual:
+			return cmp != 0, nil
+		case Greater:
+			return cmp > 0, nil
+		case Less:
+			return cmp < 0, nil
+		case GreaterEquals:
+			return cmp >= 0, nil
+		case LessEquals:
+			return cmp <= 0, nil
+		}
+	}
+	return false, errInvalidOp
+}
+
+// compareText compares the text extracted from a document with val,
+// casting the text like the queries sent to postgresql
+func compareText(text string, val interface{}) (int, error) {
+	cast, err := castFor(val)
+	if err != nil {
+		return 0, err
+	}
+	rval := reflect.ValueOf(val)
+	switch cast {
+	case "":
+		return strings.Compare(text, rval.String()), nil
+	case "numeric":
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid input syntax for type numeric: %q", text)
+		}
+		var v float64
+		switch rval.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v = rval.Float()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v = float64(rval.Uint())
+		default:
+			v = float64(rval.Int())
+		}
+		return compareFloat(n, v), nil
+	case "boolean":
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return 0, fmt.Errorf("invalid input syntax for type boolean: %q", text)
+		}
+		return compareFloat(boolNumber(b), boolNumber(rval.Bool())), nil
+	case "timestamptz":
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return 0, fmt.Errorf("invalid input syntax for type timestamp: %q", text)
+		}
+		v := val.(time.Time)
+		if t.Before(v) {
+			return -1, nil
+		} else if t.After(v) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errUnsupportedValue
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func boolNumber(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// jsonValue works like the #> operator, returns false when the path
+// don't exist
+func jsonValue(doc interface{}, propPath []string) (interface{}, bool) {
+	cur := doc
+	for _, p := range propPath {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next, has := v[p]
+			if !has {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(p)
+			if idx < 0 {
+				idx += len(v)
+			}
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			cur = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// textValue works like the #>> operator, returns false when the result
+// would be null
+func textValue(doc interface{}, propPath []string) (string, bool) {
+	val, ok := jsonValue(doc, propPath)
+	if !ok || val == nil {
+		return "", false
+	}
+	switch val := val.(type) {
+	case string:
+		return val, true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(val), true
+	}
+	buf, _ := json.Marshal(val)
+	return string(buf), true
+}
+
+// containsJSON works like the @> operator of jsonb
+func containsJSON(val, frag interface{}) bool {
+	switch frag := frag.(type) {
+	case map[string]interface{}:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, fv := range frag {
+			if v, has := obj[k]; !has || !containsJSON(v, fv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		arr, ok := val.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, fv := range frag {
+			found := false
+			for _, v := range arr {
+				if containsJSON(v, fv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	if arr, ok := val.([]interface{}); ok {
+		// an array contains a primitive value if any element is equal
+		for _, v := range arr {
+			if jsonEqual(v, frag) {
+				return true
+			}
+		}
+		return false
+	}
+	return jsonEqual(val, frag)
+}
+
+// likeRegexp converts a SQL like pattern into a regexp
+func likeRegexp(pattern string) *regexp.Regexp {
+	buf := &strings.Builder{}
+	buf.WriteString("^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			buf.WriteString(".*")
+		case c == '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.MustCompile("(?s)" + buf.String())
+}
+
+type (
+	memDocsById []*memDoc
+
+	memDocsByOrder struct {
+		docs  []*memDoc
+		order []orderBy
+	}
+)
+
+func (m memDocsById) Len() int           { return len(m) }
+func (m memDocsById) Less(i, j int) bool { return m[i].id < m[j].id }
+func (m memDocsById) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+func (m memDocsByOrder) Len() int      { return len(m.docs) }
+func (m memDocsByOrder) Swap(i, j int) { m.docs[i], m.docs[j] = m.docs[j], m.docs[i] }
+func (m memDocsByOrder) Less(i, j int) bool {
+	for _, o := range m.order {
+		a, aok := textValue(m.docs[i].doc, o.path)
+		b, bok := textValue(m.docs[j].doc, o.path)
+		var cmp int
+		switch {
+		case aok && bok:
+			cmp = strings.Compare(a, b)
+		case aok:
+			// nulls are the largest values, like in postgresql
+			cmp = -1
+		case bok:
+			cmp = 1
+		}
+		if o.desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package pgdoc
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryTable(t *testing.T) {
+	var store Store = NewMemoryStore()
+	defer store.Close()
+
+	tbl, err := store.OpenTable("memdocs")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	if err := store.Unique(tbl.Name(), "memdocs_name", "Name"); err != nil {
+		t.Fatalf("error creating index: %v", err)
+	}
+	if err := store.Unique(tbl.Name(), "memdocs_name", "Name"); err != ErrIndexAlreadyExists {
+		t.Errorf("expecting %v got %v", ErrIndexAlreadyExists, err)
+	}
+
+	type person struct {
+		Id   string
+		Rev  int64
+		Name string
+		Age  int
+		Tags []string
+	}
+
+	persons := []person{
+		{Name: "Bob", Age: 30, Tags: []string{"admin"}},
+		{Name: "Tom", Age: 20},
+		{Name: "Ann", Age: 40, Tags: []string{"admin", "dev"}},
+	}
+	if err := tbl.SaveMany(persons[0]); err != errValNotASlice {
+		t.Errorf("expecting %v got %v", errValNotASlice, err)
+	}
+	if err := tbl.SaveMany(persons); err != nil {
+		t.Fatalf("error saving persons: %v", err)
+	}
+
+	var loaded person
+	if err := tbl.Load(&loaded, persons[0].Id); err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if loaded.Name != "Bob" || loaded.Rev != 1 {
+		t.Errorf("expecting Bob with rev 1 got %v", loaded)
+	}
+	if err := tbl.Load(&loaded, "invalid"); err != sql.ErrNoRows {
+		t.Errorf("expecting %v got %v", sql.ErrNoRows, err)
+	}
+
+	dup := person{Name: "Bob"}
+	if _, err := tbl.Save(&dup); err == nil {
+		t.Errorf("unique index should reject a second Bob")
+	}
+
+	loaded.Age = 31
+	if _, err := tbl.Save(&loaded); err != nil || loaded.Rev != 2 {
+		t.Errorf("error updating: %v rev %v", err, loaded.Rev)
+	}
+	if _, err := tbl.Save(&persons[0]); err != ErrConflict || persons[0].Rev != 1 {
+		t.Errorf("expecting %v got %v rev %v", ErrConflict, err, persons[0].Rev)
+	}
+
+	names := func(it Iterator) []string {
+		var out []string
+		for it.Next() {
+			var p person
+			if err := it.Scan(&p); err != nil {
+				t.Errorf("error scaning from iterator: %v", err)
+			}
+			out = append(out, p.Name)
+		}
+		if it.Err() != nil {
+			t.Errorf("unexpected error: %v", it.Err())
+		}
+		return out
+	}
+
+	if got := names(tbl.Find().Where(Greater, 25, "Age").OrderBy("Name").Iter()); !reflect.DeepEqual(got, []string{"Ann", "Bob"}) {
+		t.Errorf("expecting [Ann Bob] got %v", got)
+	}
+	if got := names(tbl.Find().Where(In, []string{"Tom", "Bob"}, "Name").OrderByDesc("Name").Limit(1).Iter()); !reflect.DeepEqual(got, []string{"Tom"}) {
+		t.Errorf("expecting [Tom] got %v", got)
+	}
+	if got := names(tbl.Find().Where(Like, "_o%", "Name").OrderBy("Name").Offset(1).Iter()); !reflect.DeepEqual(got, []string{"Tom"}) {
+		t.Errorf("expecting [Tom] got %v", got)
+	}
+	if got := names(tbl.Find().Where(Exists, nil, "Tags", "1").Iter()); !reflect.DeepEqual(got, []string{"Ann"}) {
+		t.Errorf("expecting [Ann] got %v", got)
+	}
+	if got := names(tbl.Contains(map[string]interface{}{"Tags": []string{"admin"}})); len(got) != 2 {
+		t.Errorf("expecting two admins got %v", got)
+	}
+
+	var all []*person
+	if err := tbl.Find().OrderBy("Name").Iter().ScanAll(&all); err != nil || len(all) != 3 || all[0].Name != "Ann" {
+		t.Errorf("expecting 3 persons starting with Ann got %v: %v", all, err)
+	}
+	if err := tbl.Find().Iter().ScanAll(all); err != errValNotASlicePtr {
+		t.Errorf("expecting %v got %v", errValNotASlicePtr, err)
+	}
+
+	it := tbl.Find().Where(In, "Bob", "Name").Iter()
+	if it.Next() || it.Err() != errInNeedsSlice {
+		t.Errorf("expecting %v got %v", errInNeedsSlice, it.Err())
+	}
+
+	if n, err := tbl.DeleteWhere(tbl.Find().Where(Less, 35, "Age")); err != nil || n != 2 {
+		t.Errorf("expecting 2 documents deleted got %v: %v", n, err)
+	}
+	if got := names(tbl.Find().Iter()); !reflect.DeepEqual(got, []string{"Ann"}) {
+		t.Errorf("expecting [Ann] got %v", got)
+	}
+}
+
+func TestMemoryLink(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	tbl, err := store.OpenTable("memnodes")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	lnk, err := store.OpenLink("memlinks")
+	if err != nil {
+		t.Fatalf("error opening link: %v", err)
+	}
+	store.CascadeLinks(tbl.Name(), lnk.Name())
+
+	type node struct {
+		Id string
+	}
+	type edge struct {
+		Id   string
+		From string
+		To   string
+	}
+
+	a, b := node{}, node{}
+	for _, n := range []*node{&a, &b} {
+		if _, err := tbl.Save(n); err != nil {
+			t.Fatalf("error saving node: %v", err)
+		}
+	}
+
+	if _, err := lnk.Connect(&edge{From: a.Id}); err != errInvalidLink {
+		t.Errorf("expecting %v got %v", errInvalidLink, err)
+	}
+	e := edge{From: a.Id, To: b.Id}
+	if _, err := lnk.Connect(&e); err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	var loaded edge
+	if err := lnk.Load(&loaded, e.Id); err != nil || loaded != e {
+		t.Errorf("expecting %v got %v: %v", e, loaded, err)
+	}
+
+	count := func(it Iterator) int {
+		n := 0
+		for it.Next() {
+			n++
+		}
+		return n
+	}
+	if n := count(lnk.From(a.Id)); n != 1 {
+		t.Errorf("expecting 1 link from a got %v", n)
+	}
+	if n := count(lnk.LoadMany(b.Id, "", "edge")); n != 0 {
+		t.Errorf("expecting 0 links from b got %v", n)
+	}
+	if n := count(lnk.Label("edge")); n != 1 {
+		t.Errorf("expecting 1 link with label edge got %v", n)
+	}
+
+	if err := tbl.Delete(b.Id); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	if err := lnk.Load(&loaded, e.Id); err != sql.ErrNoRows {
+		t.Errorf("link should be removed with the node, got %v", err)
+	}
+}
+
+func TestMemoryRevisionField(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+	tbl, err := store.OpenTable("memrevs")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+
+	// a Rev that isn't a number is a regular field
+	type note struct {
+		Id  string
+		Rev string
+	}
+	n := note{Rev: "draft"}
+	if _, err := tbl.Save(&n); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	if _, err := tbl.Save(&n); err != nil {
+		t.Fatalf("error saving again: %v", err)
+	}
+	var loaded note
+	if err := tbl.Load(&loaded, n.Id); err != nil || loaded.Rev != "draft" {
+		t.Errorf("expecting rev draft got %v: %v", loaded, err)
+	}
+}
+
+func TestMemoryCascadeFailure(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	tbl, err := store.OpenTable("memcascade")
+	if err != nil {
+		t.Fatalf("error opening table: %v", err)
+	}
+	// the link doesn't exist, so the delete fails
+	store.CascadeLinks(tbl.Name(), "memmissing")
+
+	type node struct {
+		Id string
+	}
+	n := node{}
+	if _, err := tbl.Save(&n); err != nil {
+		t.Fatalf("error saving node: %v", err)
+	}
+	if err := tbl.Delete(n.Id); err == nil {
+		t.Errorf("delete should fail when a cascaded link is missing")
+	}
+	var loaded node
+	if err := tbl.Load(&loaded, n.Id); err != nil {
+		t.Errorf("a failed delete should keep the document: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+)
+
+// metaTable holds information about the other tables, like their
+// schemas, that must be shared by every process using the database.
+const metaTable = "pgdoc_meta"
+
+// ensureMeta creates the metadata table using db, the table is only
+// known to exist after a transaction commits so inside one it is
+// checked every time.
+func (d *Database) ensureMeta(db querier) error {
+	d.mu.RLock()
+	ready := d.metaReady
+	d.mu.RUnlock()
+	if ready {
+		return nil
+	}
+	td := tableDef{
+		name: metaTable,
+		def: []columnDef{
+			columnDef{
+				name:    "tblname",
+				kind:    "varchar(100)",
+				notnull: "not null",
+				pk:      true,
+			},
+			columnDef{
+				name:    "kind",
+				kind:    "varchar(40)",
+				notnull: "not null",
+				pk:      true,
+			},
+			columnDef{
+				name:    "body",
+				kind:    "json",
+				notnull: "not null",
+			},
+		},
+	}
+	if err := d.ensure(db, &td); err != nil {
+		return err
+	}
+	if _, inTx := db.(*sql.Tx); !inTx {
+		d.mu.Lock()
+		d.metaReady = true
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// setMeta save val as the information of the given kind about table
+func (d *Database) setMeta(table, kind string, val interface{}) error {
+	return d.setMetaOn(d.db, table, kind, val)
+}
+
+func (d *Database) setMetaOn(db querier, table, kind string, val interface{}) error {
+	if err := d.ensureMeta(db); err != nil {
+		return err
+	}
+	_, err := db.Exec("insert into "+metaTable+" (tblname, kind, body) values ($1, $2, $3) on conflict (tblname, kind) do update set body = excluded.body",
+		table, kind, jsonCol{val, nil}.plain())
+	return err
+}
+
+// getMeta load the information of the given kind about table into out,
+// returns false if there is no information
+func (d *Database) getMeta(ctx context.Context, table, kind string, out interface{}) (bool, error) {
+	return d.getMetaOn(ctx, d.db, table, kind, out)
+}
+
+func (d *Database) getMetaOn(ctx context.Context, db querier, table, kind string, out interface{}) (bool, error) {
+	if err := d.ensureMeta(db); err != nil {
+		return false, err
+	}
+	err := db.QueryRowContext(ctx, "select body from "+metaTable+" where tblname = $1 and kind = $2", table, kind).Scan(&jsonCol{out, nil})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Database) deleteMeta(table, kind string) error {
+	if err := d.ensureMeta(d.db); err != nil {
+		return err
+	}
+	_, err := d.db.Exec("delete from "+metaTable+" where tblname = $1 and kind = $2", table, kind)
+	return err
+}
@@ -0,0 +1,295 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+type (
+	// MigrateFunc changes a document from the layout of the previous
+	// version to the layout of the version it was registered with.
+	// Numbers are decoded as json.Number, so they keep their precision.
+	//
+	// The function must accept documents that already use the new
+	// layout, since documents saved while Migrate runs aren't
+	// distinguished from the old ones.
+	//
+	// Encrypted fields (see Database.SetKeyProvider) are only seen in
+	// plain text by the functions registered with
+	// RegisterTypedMigration.
+	MigrateFunc func(doc map[string]interface{}) error
+
+	migration struct {
+		version int
+		fn      MigrateFunc
+		// type of the migrated documents, nil if unknown
+		tp reflect.Type
+	}
+
+	// migrationState is saved in the metadata table, in the same
+	// transaction that rewrites each batch
+	migrationState struct {
+		// highest version applied to every document
+		Version int
+		// every version applied to every document
+		Applied []int `json:",omitempty"`
+		// version being applied and the last document it rewrote,
+		// empty if none started
+		Current int    `json:",omitempty"`
+		After   string `json:",omitempty"`
+	}
+)
+
+const (
+	migrationsMeta = "migrations"
+	// how many documents are rewritten by each transaction of Migrate
+	migrateBatch = 500
+)
+
+var (
+	errInvalidMigrationVersion = errors.New("migration versions must be greater than zero")
+	errNilMigration            = errors.New("migration without a function")
+	errMigrateEncrypted        = errors.New("documents with encrypted fields require RegisterTypedMigration")
+)
+
+// RegisterMigration adds fn as the migration that moves the documents
+// of table to the given version, see Migrate. Versions must be unique
+// for each table but don't need to be sequential.
+//
+// Migrate fails on documents with encrypted fields, use
+// RegisterTypedMigration for them.
+func (d *Database) RegisterMigration(table string, version int, fn MigrateFunc) error {
+	return d.registerMigration(table, version, nil, fn)
+}
+
+// RegisterTypedMigration is like RegisterMigration, but the encrypted
+// fields of the documents are decrypted before calling fn, and the
+// fields tagged with pgdoc:"encrypt" in the type of doc, a value of
+// the new layout, are encrypted after it.
+func (d *Database) RegisterTypedMigration(table string, version int, doc interface{}, fn MigrateFunc) error {
+	return d.registerMigration(table, version, reflect.TypeOf(doc), fn)
+}
+
+func (d *Database) registerMigration(table string, version int, tp reflect.Type, fn MigrateFunc) error {
+	if version <= 0 {
+		return errInvalidMigrationVersion
+	}
+	if fn == nil {
+		return errNilMigration
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.migrations == nil {
+		d.migrations = make(map[string][]migration)
+	}
+	list := d.migrations[table]
+	for _, m := range list {
+		if m.version == version {
+			return fmt.Errorf("%v: migration %v already registered", table, version)
+		}
+	}
+	list = append(list, migration{version, fn, tp})
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	d.migrations[table] = list
+	return nil
+}
+
+// Migrate applies the registered migrations that weren't applied yet,
+// in order of version. Each migration rewrites every document of the
+// table, including the expired ones, and increments their revision.
+//
+// Applied versions are recorded, so a migration registered later with
+// a lower version than the ones already applied still runs.
+//
+// Documents are rewritten in batches, each batch in its own
+// transaction that also records the progress in the metadata table.
+// If Migrate is interrupted the next call continues after the last
+// batch, and concurrent calls wait for each other instead of
+// rewriting the same documents.
+//
+// Schemas aren't checked, so update the schema of the table after
+// the documents use the new layout.
+func (d *Database) Migrate(ctx context.Context) error {
+	d.mu.RLock()
+	tables := make([]string, 0, len(d.migrations))
+	for name := range d.migrations {
+		tables = append(tables, name)
+	}
+	d.mu.RUnlock()
+	sort.Strings(tables)
+	for _, name := range tables {
+		if err := d.migrateTable(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationVersion return the highest migration applied to every
+// document of table, zero if none.
+func (d *Database) MigrationVersion(table string) (int, error) {
+	var state migrationState
+	_, err := d.getMeta(context.Background(), table, migrationsMeta, &state)
+	return state.Version, err
+}
+
+func (d *Database) migrateTable(ctx context.Context, table string) error {
+	d.mu.RLock()
+	list := append([]migration(nil), d.migrations[table]...)
+	d.mu.RUnlock()
+	// creates the table if needed, a new table is migrated at once
+	t, err := d.Table(table)
+	if err != nil {
+		return err
+	}
+	if err := d.ensureMeta(d.db); err != nil {
+		return err
+	}
+	for {
+		var done bool
+		err := d.inTransaction(ctx, d.db, func(tx *sql.Tx) error {
+			var err error
+			done, err = t.migrateBatch(ctx, tx, list)
+			return err
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateBatch rewrites the next batch of documents, returns true
+// when every migration was applied.
+func (t *Table) migrateBatch(ctx context.Context, tx *sql.Tx, list []migration) (bool, error) {
+	// the row of the table is locked until the end of the batch
+	_, err := tx.ExecContext(ctx, "insert into "+metaTable+" (tblname, kind, body) values ($1, $2, $3) on conflict (tblname, kind) do nothing",
+		t.name, migrationsMeta, jsonCol{migrationState{}, nil}.plain())
+	if err != nil {
+		return false, err
+	}
+	var state migrationState
+	err = tx.QueryRowContext(ctx, "select body from "+metaTable+" where tblname = $1 and kind = $2 for update",
+		t.name, migrationsMeta).Scan(&jsonCol{&state, nil})
+	if err != nil {
+		return false, err
+	}
+	next := state.next(list)
+	if next == nil {
+		return true, nil
+	}
+	if next.version != state.Current {
+		state.Current, state.After = next.version, ""
+	}
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("select docid, rev, body from %v where docid > $1 order by docid limit %d for update", t.name, migrateBatch), state.After)
+	if err != nil {
+		return false, err
+	}
+	type rewrite struct {
+		id   string
+		body string
+	}
+	var batch []rewrite
+	key := revKey(next.tp)
+	for rows.Next() {
+		var id string
+		var rev int64
+		var body []byte
+		if err := rows.Scan(&id, &rev, &body); err != nil {
+			rows.Close()
+			return false, err
+		}
+		doc := make(map[string]interface{})
+		dec := json.NewDecoder(bytes.NewBuffer(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			rows.Close()
+			return false, err
+		}
+		out, err := t.migrateDoc(ctx, next, doc)
+		if err != nil {
+			rows.Close()
+			return false, fmt.Errorf("%v: migration %v of %v: %v", t.name, next.version, id, err)
+		}
+		// like Save, the body carries the new revision
+		if m, ok := out.(map[string]interface{}); ok {
+			if _, has := m[key]; has {
+				m[key] = rev + 1
+			}
+		}
+		// migrateDoc already encrypted the tagged fields
+		batch = append(batch, rewrite{id, jsonCol{out, nil}.plain()})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, r := range batch {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("update %v set body = $2, rev = rev + 1 where docid = $1", t.name), r.id, r.body); err != nil {
+			return false, err
+		}
+	}
+
+	if len(batch) < migrateBatch {
+		state.Applied = append(state.Applied, next.version)
+		sort.Ints(state.Applied)
+		state.Version = state.Applied[len(state.Applied)-1]
+		state.Current, state.After = 0, ""
+	} else {
+		state.After = batch[len(batch)-1].id
+	}
+	_, err = tx.ExecContext(ctx, "update "+metaTable+" set body = $3 where tblname = $1 and kind = $2",
+		t.name, migrationsMeta, jsonCol{state, nil}.plain())
+	return false, err
+}
+
+// next return the migration that should be applied, the one in
+// progress or the first one that wasn't applied, nil if none
+func (s *migrationState) next(list []migration) *migration {
+	applied := make(map[int]bool, len(s.Applied))
+	for _, v := range s.Applied {
+		applied[v] = true
+	}
+	var first *migration
+	for i := range list {
+		if list[i].version == s.Current && len(s.After) > 0 {
+			return &list[i]
+		}
+		if first == nil && !applied[list[i].version] {
+			first = &list[i]
+		}
+	}
+	return first
+}
+
+// migrateDoc applies m to doc, decrypting and encrypting the fields
+// when m has a type
+func (t *Table) migrateDoc(ctx context.Context, m *migration, doc map[string]interface{}) (interface{}, error) {
+	encrypted := hasCiphertext(doc)
+	if m.tp == nil {
+		if encrypted {
+			return nil, errMigrateEncrypted
+		}
+		return doc, m.fn(doc)
+	}
+	if !encrypted && !hasEncrypted(m.tp) {
+		return doc, m.fn(doc)
+	}
+	c, err := t.owner.fieldCipher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.decryptAll(doc); err != nil {
+		return nil, err
+	}
+	if err := m.fn(doc); err != nil {
+		return nil, err
+	}
+	return cryptValue(m.tp, doc, c.encrypt)
+}
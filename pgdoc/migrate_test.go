@@ -0,0 +1,100 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegisterMigration(t *testing.T) {
+	d := WrapDB(nil)
+	noop := func(doc map[string]interface{}) error { return nil }
+	for _, v := range []int{3, 1, 2} {
+		if err := d.RegisterMigration("docs", v, noop); err != nil {
+			t.Fatalf("error registering %v: %v", v, err)
+		}
+	}
+	if err := d.RegisterMigration("docs", 2, noop); err == nil {
+		t.Errorf("duplicated version should be rejected")
+	}
+	if err := d.RegisterMigration("docs", 0, noop); err != errInvalidMigrationVersion {
+		t.Errorf("expecting %v got %v", errInvalidMigrationVersion, err)
+	}
+	if err := d.RegisterMigration("docs", 4, nil); err != errNilMigration {
+		t.Errorf("expecting %v got %v", errNilMigration, err)
+	}
+	if err := d.RegisterTypedMigration("docs", 1, struct{}{}, noop); err == nil {
+		t.Errorf("typed migrations share the versions")
+	}
+	for i, m := range d.migrations["docs"] {
+		if m.version != i+1 {
+			t.Errorf("expecting version %v at %v got %v", i+1, i, m.version)
+		}
+	}
+}
+
+func TestMigrateEncrypted(t *testing.T) {
+	c, err := newFieldCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("error creating cipher: %v", err)
+	}
+	d := WrapDB(nil)
+	d.cipher = c
+	tbl := &Table{name: "docs", owner: d}
+
+	phone, _ := c.encrypt("555-1234", false)
+	doc := func() map[string]interface{} {
+		return map[string]interface{}{"Name": "Bob", "Phone": phone}
+	}
+	// moves the phone into a list of contacts
+	fn := func(doc map[string]interface{}) error {
+		if p, ok := doc["Phone"].(string); ok {
+			if p != "555-1234" {
+				t.Errorf("expecting the phone in plain text got %v", p)
+			}
+			doc["Phones"] = []interface{}{p}
+			delete(doc, "Phone")
+		}
+		return nil
+	}
+
+	if _, err := tbl.migrateDoc(context.Background(), &migration{1, fn, nil}, doc()); err != errMigrateEncrypted {
+		t.Errorf("expecting %v got %v", errMigrateEncrypted, err)
+	}
+
+	type v1 struct {
+		Name   string
+		Phones []string `pgdoc:"encrypt"`
+	}
+	out, err := tbl.migrateDoc(context.Background(), &migration{1, fn, reflect.TypeOf(v1{})}, doc())
+	if err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+	body := jsonCol{out, nil}.plain()
+	if strings.Contains(body, "555-1234") || !strings.Contains(body, "Bob") {
+		t.Errorf("only the phones should be encrypted: %v", body)
+	}
+	var loaded v1
+	if err := (jsonCol{&loaded, d}).Scan(body); err != nil || loaded.Name != "Bob" || len(loaded.Phones) != 1 || loaded.Phones[0] != "555-1234" {
+		t.Errorf("expecting the migrated phone got %v: %v", loaded, err)
+	}
+}
+
+func TestMigrationStateNext(t *testing.T) {
+	list := []migration{{version: 1}, {version: 3}, {version: 5}}
+	s := migrationState{Version: 5, Applied: []int{1, 5}}
+	if next := s.next(list); next == nil || next.version != 3 {
+		t.Errorf("expecting version 3 got %v", next)
+	}
+	// the migration in progress goes first
+	s = migrationState{Applied: []int{1}, Current: 5, After: "doc"}
+	if next := s.next(list); next == nil || next.version != 5 {
+		t.Errorf("expecting version 5 got %v", next)
+	}
+	s = migrationState{Version: 5, Applied: []int{1, 3, 5}}
+	if next := s.next(list); next != nil {
+		t.Errorf("expecting nothing to apply got %v", next)
+	}
+}
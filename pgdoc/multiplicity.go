@@ -0,0 +1,171 @@
+package pgdoc
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"unicode"
+)
+
+type (
+	// Multiplicity limits how many links with the same label a
+	// document can have, see Link.Constrain
+	Multiplicity string
+
+	// LinkConstraintError is returned by Connect when the link
+	// violates the multiplicity of its label
+	LinkConstraintError struct {
+		Link         string
+		Label        string
+		From         string
+		To           string
+		Multiplicity Multiplicity
+	}
+)
+
+const (
+	// A pair of documents can't have the same link twice
+	UniquePair = Multiplicity("unique pair")
+	// Each document has at most one link as From and one as To
+	OneToOne = Multiplicity("one to one")
+	// Each document has at most one link as To, ie, one parent with
+	// many children
+	OneToMany = Multiplicity("one to many")
+	// Each document has at most one link as From, ie, a user has at
+	// most one manager
+	ManyToOne = Multiplicity("many to one")
+
+	multiplicityMeta = "multiplicity"
+	// prefix of the indexes created by Constrain
+	multiplicityIndex = "idx_m_"
+	uniqueViolation   = "23505"
+)
+
+var (
+	// columns of each unique index used to enforce a multiplicity
+	multiplicityCols = map[Multiplicity][][]string{
+		UniquePair: {{"_from", "_to"}},
+		OneToOne:   {{"_from"}, {"_to"}},
+		OneToMany:  {{"_to"}},
+		ManyToOne:  {{"_from"}},
+	}
+)
+
+func (e *LinkConstraintError) Error() string {
+	return fmt.Sprintf("%v: link %v from %v to %v violates %v", e.Link, e.Label, e.From, e.To, e.Multiplicity)
+}
+
+// Constrain enforces m on the links with the given label, using
+// unique indexes. Replaces the previous multiplicity of the label and
+// fails if the existing links violate m.
+func (l *Link) Constrain(label string, m Multiplicity) error {
+	cols, ok := multiplicityCols[m]
+	if !ok {
+		return fmt.Errorf("invalid multiplicity %q", m)
+	}
+	err := l.owner.inTransaction(context.Background(), l.db, func(tx *sql.Tx) error {
+		if err := l.dropConstraint(tx, label); err != nil {
+			return err
+		}
+		for _, c := range cols {
+			_, err := tx.Exec(fmt.Sprintf("create unique index %v on %v (%v) where label = %v",
+				l.constraintIndex(label, m, c), l.name, strings.Join(c, ", "), pq.QuoteLiteral(label)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	all, err := l.multiplicities()
+	if err != nil {
+		return err
+	}
+	all[label] = m
+	return l.owner.setMeta(l.name, multiplicityMeta, all)
+}
+
+// RemoveConstraint stop enforcing the multiplicity of label
+func (l *Link) RemoveConstraint(label string) error {
+	if err := l.dropConstraint(l.db, label); err != nil {
+		return err
+	}
+	all, err := l.multiplicities()
+	if err != nil {
+		return err
+	}
+	delete(all, label)
+	return l.owner.setMeta(l.name, multiplicityMeta, all)
+}
+
+// Multiplicity return the multiplicity of label, empty if the label
+// has none
+func (l *Link) Multiplicity(label string) (Multiplicity, error) {
+	all, err := l.multiplicities()
+	return all[label], err
+}
+
+func (l *Link) multiplicities() (map[string]Multiplicity, error) {
+	all := make(map[string]Multiplicity)
+	if _, err := l.owner.getMeta(context.Background(), l.name, multiplicityMeta, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (l *Link) dropConstraint(db querier, label string) error {
+	for m, cols := range multiplicityCols {
+		for _, c := range cols {
+			if _, err := db.Exec(fmt.Sprintf("drop index if exists %v", l.constraintIndex(label, m, c))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// constraintIndex return the name of the index that enforces the
+// multiplicity m of label over the given columns.
+//
+// Index names are global and postgresql truncates them after 63
+// bytes, so the name is a hash of the link, the multiplicity, the
+// columns and the label, which also lets constraintError find the
+// multiplicity from the name alone.
+func (l *Link) constraintIndex(label string, m Multiplicity, cols []string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v/%v", l.name, m, strings.Join(cols, ","), label)))
+	return fmt.Sprintf("%v%x", multiplicityIndex, sum[:16])
+}
+
+// identifier return s in lower case, replacing everything but ascii
+// letters and digits with _
+func identifier(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, s)
+}
+
+// constraintError converts the unique violations of the indexes
+// created by Constrain into a LinkConstraintError, other errors are
+// returned as is.
+func (l *Link) constraintError(err error, from, to, label string) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != uniqueViolation {
+		return err
+	}
+	for m, cols := range multiplicityCols {
+		for _, c := range cols {
+			if l.constraintIndex(label, m, c) == pqErr.Constraint {
+				return &LinkConstraintError{l.name, label, from, to, m}
+			}
+		}
+	}
+	return err
+}
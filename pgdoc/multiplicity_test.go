@@ -0,0 +1,37 @@
+package pgdoc
+
+import (
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestConstraintIndex(t *testing.T) {
+	// names this long used to be truncated into the same index
+	l := &Link{name: strings.Repeat("l", 60)}
+	names := make(map[string]bool)
+	for m, cols := range multiplicityCols {
+		for _, c := range cols {
+			name := l.constraintIndex("friend", m, c)
+			if len(name) > 63 {
+				t.Errorf("index name longer than 63 bytes: %v", name)
+			}
+			if names[name] {
+				t.Errorf("duplicated index name %v", name)
+			}
+			names[name] = true
+		}
+	}
+	if len(names) != 5 {
+		t.Errorf("expecting 5 index names got %v", len(names))
+	}
+
+	err := &pq.Error{Code: uniqueViolation, Constraint: l.constraintIndex("friend", OneToOne, []string{"_to"})}
+	ce, ok := l.constraintError(err, "bob", "ann", "friend").(*LinkConstraintError)
+	if !ok || ce.Multiplicity != OneToOne || ce.From != "bob" || ce.To != "ann" {
+		t.Errorf("expecting a LinkConstraintError got %v", ce)
+	}
+	if got := l.constraintError(err, "bob", "ann", "manager"); got != err {
+		t.Errorf("indexes of other labels should be kept, got %v", got)
+	}
+}
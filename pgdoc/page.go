@@ -0,0 +1,229 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+type (
+	// pageToken is the position after the last document of a page,
+	// encoded as base64 json so callers treat it as opaque.
+	pageToken struct {
+		// path used to sort the documents, a token can only continue
+		// a query with the same order
+		Path []string `json:"p,omitempty"`
+		Desc bool     `json:"d,omitempty"`
+		// text value at Path, nil when the document don't have it
+		Key *string `json:"k,omitempty"`
+		Id  string  `json:"id"`
+	}
+)
+
+var (
+	errInvalidPageToken = errors.New("invalid page token")
+	errInvalidPageSize  = errors.New("page size must be greater than zero")
+	errPageOrder        = errors.New("pages can be sorted by at most one path")
+	errPageUnsupported  = errors.New("store don't support pages")
+)
+
+// Page reads up to size documents that match the filters of q into
+// the slice pointed by out, replacing its contents, and return the
+// token of the next page. An empty token reads the first page and an
+// empty next token means there are no more documents.
+//
+// Pages use the position of the last document instead of an offset,
+// so documents inserted or removed between calls don't cause
+// duplicates or gaps. Documents are sorted by the first OrderBy (or
+// OrderByDesc) path and by id, without an order only the id is
+// used. An index on the order path (see Database.CreateIndex) avoids
+// sorting the whole table. Limit and Offset are ignored.
+func (q *Query) Page(token string, size int, out interface{}) (string, error) {
+	return q.PageContext(context.Background(), token, size, out)
+}
+
+func (q *Query) PageContext(ctx context.Context, token string, size int, out interface{}) (string, error) {
+	t, ok := q.runner.(*Table)
+	if !ok {
+		return "", errPageUnsupported
+	}
+	if len(q.order) > 1 {
+		return "", errPageOrder
+	}
+	var order *orderBy
+	if len(q.order) == 1 {
+		if len(q.order[0].path) == 0 {
+			return "", errEmptyPath
+		}
+		order = &q.order[0]
+	}
+	after, err := decodePageToken(token, order)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	key := "null::text"
+	if order != nil {
+		key = textPath(order.path)
+	}
+	fmt.Fprintf(buf, "select body, docid, %v from %v where %v", key, t.name, notExpired)
+	params, err := t.writeWhere(buf, q)
+	if err != nil {
+		return "", err
+	}
+	if after != nil {
+		params = after.writeTo(buf, params, key)
+	}
+	dir := ""
+	if order != nil && order.desc {
+		dir = " desc"
+	}
+	if order != nil {
+		fmt.Fprintf(buf, " order by %v%v, docid%v", key, dir, dir)
+	} else {
+		fmt.Fprintf(buf, " order by docid")
+	}
+	last, err := readPage(ctx, t.db, t.owner, string(buf.Bytes()), params, size, out)
+	if last == nil || err != nil {
+		return "", err
+	}
+	if order != nil {
+		last.Path, last.Desc = order.path, order.desc
+	}
+	return last.encode(), nil
+}
+
+// LoadPage is like LoadMany but reads up to size links into the slice
+// pointed by out, sorted by id. See Query.Page for the tokens.
+func (l *Link) LoadPage(from, to, label, token string, size int, out interface{}) (string, error) {
+	return l.LoadPageContext(context.Background(), from, to, label, token, size, out)
+}
+
+func (l *Link) LoadPageContext(ctx context.Context, from, to, label, token string, size int, out interface{}) (string, error) {
+	after, err := decodePageToken(token, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "select body, linkid, null::text from %v where", l.name)
+	params, err := l.writeMatch(buf, from, to, label)
+	if err != nil {
+		return "", err
+	}
+	if after != nil {
+		params = append(params, after.Id)
+		fmt.Fprintf(buf, " and linkid > $%v", len(params))
+	}
+	fmt.Fprintf(buf, " order by linkid")
+	last, err := readPage(ctx, l.db, l.owner, string(buf.Bytes()), params, size, out)
+	if last == nil || err != nil {
+		return "", err
+	}
+	return last.encode(), nil
+}
+
+// readPage runs query, which must select the body, the id and the key
+// of the documents, and scan the first size documents into out.
+//
+// Return the position of the last document read, nil if there are
+// no more documents.
+func readPage(ctx context.Context, db querier, d *Database, query string, params []interface{}, size int, out interface{}) (*pageToken, error) {
+	if size <= 0 {
+		return nil, errInvalidPageSize
+	}
+	if _, ok := d.reflector.NewElem(out); !ok {
+		return nil, errValNotASlicePtr
+	}
+	// one more, to know if there is a next page
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%v limit %d", query, size+1), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slice := reflect.ValueOf(out).Elem()
+	slice.Set(slice.Slice(0, 0))
+	var last pageToken
+	for n := 0; rows.Next(); n++ {
+		if n == size {
+			return &last, rows.Close()
+		}
+		elem, _ := d.reflector.NewElem(out)
+		var key sql.NullString
+		if err := rows.Scan(&jsonCol{elem, d}, &last.Id, &key); err != nil {
+			return nil, err
+		}
+		last.Key = nil
+		if key.Valid {
+			last.Key = &key.String
+		}
+		d.reflector.Append(out, elem)
+	}
+	return nil, rows.Err()
+}
+
+// writeTo appends the condition that selects the documents after p,
+// using the same null order as postgresql: nulls are greater than
+// any value.
+func (p *pageToken) writeTo(buf *bytes.Buffer, params []interface{}, key string) []interface{} {
+	params = append(params, p.Id)
+	id := len(params)
+	if len(p.Path) == 0 {
+		fmt.Fprintf(buf, " and docid > $%v", id)
+		return params
+	}
+	switch {
+	case p.Key == nil && !p.Desc:
+		fmt.Fprintf(buf, " and (%v is null and docid > $%v)", key, id)
+	case p.Key == nil && p.Desc:
+		fmt.Fprintf(buf, " and (%v is not null or docid < $%v)", key, id)
+	case !p.Desc:
+		params = append(params, *p.Key)
+		fmt.Fprintf(buf, " and (%v > $%v or (%v = $%v and docid > $%v) or %v is null)", key, len(params), key, len(params), id, key)
+	default:
+		params = append(params, *p.Key)
+		fmt.Fprintf(buf, " and (%v < $%v or (%v = $%v and docid < $%v))", key, len(params), key, len(params), id)
+	}
+	return params
+}
+
+func (p *pageToken) encode() string {
+	buf, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodePageToken return nil for the empty token, tokens created with
+// a different order than the given one are invalid.
+func decodePageToken(token string, order *orderBy) (*pageToken, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+	p := &pageToken{}
+	if err := json.Unmarshal(buf, p); err != nil || len(p.Id) == 0 {
+		return nil, errInvalidPageToken
+	}
+	if order == nil {
+		if len(p.Path) > 0 {
+			return nil, errInvalidPageToken
+		}
+		return p, nil
+	}
+	if p.Desc != order.desc || len(p.Path) != len(order.path) {
+		return nil, errInvalidPageToken
+	}
+	for i := range p.Path {
+		if p.Path[i] != order.path[i] {
+			return nil, errInvalidPageToken
+		}
+	}
+	return p, nil
+}
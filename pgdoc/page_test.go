@@ -0,0 +1,32 @@
+package pgdoc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageToken(t *testing.T) {
+	key := "Bob"
+	order := &orderBy{[]string{"Name"}, true}
+	token := (&pageToken{Path: order.path, Desc: true, Key: &key, Id: "42"}).encode()
+	p, err := decodePageToken(token, order)
+	if err != nil {
+		t.Fatalf("error decoding token: %v", err)
+	}
+	expected := &pageToken{Path: []string{"Name"}, Desc: true, Key: &key, Id: "42"}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("expecting %v got %v", expected, p)
+	}
+
+	if p, err := decodePageToken("", order); p != nil || err != nil {
+		t.Errorf("empty token should read the first page, got %v: %v", p, err)
+	}
+	for _, o := range []*orderBy{nil, {[]string{"Name"}, false}, {[]string{"Age"}, true}} {
+		if _, err := decodePageToken(token, o); err != errInvalidPageToken {
+			t.Errorf("token used with order %v: expecting %v got %v", o, errInvalidPageToken, err)
+		}
+	}
+	if _, err := decodePageToken("not a token", nil); err != errInvalidPageToken {
+		t.Errorf("expecting %v got %v", errInvalidPageToken, err)
+	}
+}
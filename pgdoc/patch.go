@@ -0,0 +1,337 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type (
+	// PatchOp is one operation of a JSON Patch (RFC 6902), a slice of
+	// PatchOp can be given to Table.Patch.
+	PatchOp struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		From  string      `json:"from,omitempty"`
+		Value interface{} `json:"value"`
+	}
+)
+
+const (
+	// RFC 7396
+	mergePatchFunction = `create or replace function pgdoc_merge_patch(target jsonb, patch jsonb) returns jsonb as $$
+declare
+	k text;
+	v jsonb;
+begin
+	if jsonb_typeof(patch) <> 'object' then
+		return patch;
+	end if;
+	if target is null or jsonb_typeof(target) <> 'object' then
+		target := '{}';
+	end if;
+	for k, v in select * from jsonb_each(patch) loop
+		if jsonb_typeof(v) = 'null' then
+			target := target - k;
+		else
+			target := jsonb_set(target, array[k], pgdoc_merge_patch(target->k, v));
+		end if;
+	end loop;
+	return target;
+end;
+$$ language plpgsql immutable`
+
+	// RFC 6901
+	pointerFunction = `create or replace function pgdoc_pointer(ptr text) returns text[] as $$
+begin
+	if ptr = '' then
+		return '{}';
+	end if;
+	if left(ptr, 1) <> '/' then
+		raise exception 'invalid json pointer: %', ptr;
+	end if;
+	return array(select replace(replace(p, '~1', '/'), '~0', '~')
+		from unnest(string_to_array(substr(ptr, 2), '/')) with ordinality as t(p, i) order by i);
+end;
+$$ language plpgsql immutable`
+
+	patchGetFunction = `create or replace function pgdoc_patch_get(target jsonb, path text[]) returns jsonb as $$
+declare
+	v jsonb;
+begin
+	v := target #> path;
+	if v is null then
+		raise exception 'path % does not exist', array_to_string(path, '/');
+	end if;
+	return v;
+end;
+$$ language plpgsql immutable`
+
+	patchAddFunction = `create or replace function pgdoc_patch_add(target jsonb, path text[], val jsonb) returns jsonb as $$
+declare
+	n int := cardinality(path);
+	parent jsonb;
+begin
+	if n = 0 then
+		return val;
+	end if;
+	parent := pgdoc_patch_get(target, path[1:n-1]);
+	if jsonb_typeof(parent) = 'array' then
+		if path[n] = '-' then
+			path[n] := jsonb_array_length(parent)::text;
+		elsif path[n] !~ '^[0-9]+$' or path[n]::int > jsonb_array_length(parent) then
+			raise exception 'invalid array index %', path[n];
+		end if;
+		return jsonb_insert(target, path, val);
+	elsif jsonb_typeof(parent) = 'object' then
+		return jsonb_set(target, path, val);
+	end if;
+	raise exception 'cannot add a value inside a %', jsonb_typeof(parent);
+end;
+$$ language plpgsql immutable`
+
+	// RFC 6902
+	jsonPatchFunction = `create or replace function pgdoc_json_patch(target jsonb, ops jsonb) returns jsonb as $$
+declare
+	op jsonb;
+	path text[];
+	val jsonb;
+begin
+	if jsonb_typeof(ops) <> 'array' then
+		raise exception 'json patch must be an array of operations';
+	end if;
+	for op in select * from jsonb_array_elements(ops) loop
+		path := pgdoc_pointer(op->>'path');
+		case op->>'op'
+		when 'add' then
+			target := pgdoc_patch_add(target, path, op->'value');
+		when 'remove' then
+			perform pgdoc_patch_get(target, path);
+			target := target #- path;
+		when 'replace' then
+			perform pgdoc_patch_get(target, path);
+			if cardinality(path) = 0 then
+				target := op->'value';
+			else
+				target := jsonb_set(target, path, op->'value', false);
+			end if;
+		when 'move' then
+			val := pgdoc_patch_get(target, pgdoc_pointer(op->>'from'));
+			target := pgdoc_patch_add(target #- pgdoc_pointer(op->>'from'), path, val);
+		when 'copy' then
+			val := pgdoc_patch_get(target, pgdoc_pointer(op->>'from'));
+			target := pgdoc_patch_add(target, path, val);
+		when 'test' then
+			if pgdoc_patch_get(target, path) <> op->'value' then
+				raise exception 'test failed for path %', op->>'path';
+			end if;
+		else
+			raise exception 'invalid json patch operation: %', op->>'op';
+		end case;
+	end loop;
+	return target;
+end;
+$$ language plpgsql immutable`
+)
+
+var (
+	errPatchEncrypted = errors.New("patches can't change encrypted fields, only remove them")
+)
+
+// Patch applies the given patch to the document with the given id
+// and loads the result into out, which can be nil.
+//
+// patch can be a merge patch (RFC 7396), ie, an object with the
+// fields that should be changed (null removes the field) or a JSON
+// Patch (RFC 6902), ie, an array of operations like []PatchOp.
+// json.RawMessage and []byte are sent as is.
+//
+// The patch is applied by the database in a single statement, so
+// unique indexes are checked as usual. If the table has a schema the
+// patched document is validated before the change is committed.
+//
+// The revision stored in the body is incremented with the document,
+// and the expiration is computed again from out like Save does. With
+// a nil out documents of tables with a TTL expire TTL after the
+// patch.
+//
+// The database can't encrypt values, so patches that write into the
+// encrypted fields of the type of out (see Database.SetKeyProvider)
+// are rejected. Removing an encrypted field is allowed. Patches with
+// a nil out aren't checked.
+//
+// Returns sql.ErrNoRows if the document doesn't exist.
+func (t *Table) Patch(out interface{}, id string, patch interface{}) error {
+	return t.PatchContext(context.Background(), out, id, patch)
+}
+
+func (t *Table) PatchContext(ctx context.Context, out interface{}, id string, patch interface{}) error {
+	if out != nil && !t.owner.reflector.IsPtr(out) {
+		return errValNotAPointer
+	}
+	body := fragmentString(patch)
+	fn := "pgdoc_merge_patch"
+	if strings.HasPrefix(strings.TrimSpace(body), "[") {
+		fn = "pgdoc_json_patch"
+	}
+	if out != nil && hasEncrypted(reflect.TypeOf(out)) {
+		if err := checkPatch(reflect.TypeOf(out), body); err != nil {
+			return err
+		}
+	}
+	if err := t.owner.installPatch(); err != nil {
+		return err
+	}
+	kind, err := t.owner.bodyType(t.name)
+	if err != nil {
+		return err
+	}
+	s, err := t.owner.schemaFor(ctx, t.db, t.name)
+	if err != nil {
+		return err
+	}
+
+	// documents saved with a revision field keep it in sync with the
+	// column, so Find and Page read the new revision
+	patchedBody := fmt.Sprintf("%v(body::jsonb, $2::jsonb)", fn)
+	query := fmt.Sprintf("update %v set body = (select case when p ? $3 then jsonb_set(p, array[$3], to_jsonb(rev + 1)) else p end from (select %v as p) as patched)::%v, rev = rev + 1 where docid = $1 and %v returning body, rev",
+		t.name, patchedBody, kind, notExpired)
+	var key string
+	if out != nil {
+		key = revKey(reflect.TypeOf(out))
+	} else {
+		key = revKey(nil)
+	}
+	var patched []byte
+	var rev int64
+	err = t.owner.inTransaction(ctx, t.db, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, id, body, key).Scan(&patched, &rev); err != nil {
+			return err
+		}
+		if s != nil {
+			var doc interface{}
+			dec := json.NewDecoder(strings.NewReader(string(patched)))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				return err
+			}
+			if errs := s.Validate(doc); len(errs) > 0 {
+				return &ValidationError{t.name, errs}
+			}
+		}
+		var expires pq.NullTime
+		switch {
+		case out != nil:
+			if err := (jsonCol{out, t.owner}).Scan(patched); err != nil {
+				return err
+			}
+			t.owner.reflector.SetFieldOrTag(out, "Rev", revTag, rev)
+			var err error
+			if expires, err = t.expiration(ctx, out); err != nil {
+				return err
+			}
+		case t.ttl > 0:
+			expires = pq.NullTime{Time: time.Now().Add(t.ttl), Valid: true}
+		default:
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("update %v set expires_at = $2 where docid = $1", t.name), id, expires)
+		return err
+	})
+	return err
+}
+
+// checkPatch return errPatchEncrypted if patch writes into an
+// encrypted field of tp. Patches that aren't json are left to the
+// database.
+func checkPatch(tp reflect.Type, patch string) error {
+	dec := json.NewDecoder(strings.NewReader(patch))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	ops, isJSONPatch := doc.([]interface{})
+	if !isJSONPatch {
+		if mergeEncrypted(tp, doc) {
+			return errPatchEncrypted
+		}
+		return nil
+	}
+	for _, op := range ops {
+		op, _ := op.(map[string]interface{})
+		if name, _ := op["op"].(string); name == "remove" {
+			continue
+		}
+		for _, key := range []string{"path", "from"} {
+			if ptr, ok := op[key].(string); ok && encryptedPath(tp, splitPointer(ptr)) {
+				return errPatchEncrypted
+			}
+		}
+	}
+	return nil
+}
+
+// mergeEncrypted return if the merge patch writes into an encrypted
+// field of tp, null values remove the field
+func mergeEncrypted(tp reflect.Type, patch interface{}) bool {
+	obj, ok := patch.(map[string]interface{})
+	if !ok {
+		// replaces the whole value
+		return hasEncrypted(tp)
+	}
+	for k, v := range obj {
+		if v == nil {
+			continue
+		}
+		next, encrypted, ok := keyType(tp, k)
+		if encrypted || (ok && mergeEncrypted(next, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPointer return the keys of a json pointer (RFC 6901), like
+// pgdoc_pointer
+func splitPointer(ptr string) []string {
+	if !strings.HasPrefix(ptr, "/") {
+		return nil
+	}
+	keys := strings.Split(ptr[1:], "/")
+	for i, k := range keys {
+		keys[i] = strings.Replace(strings.Replace(k, "~1", "/", -1), "~0", "~", -1)
+	}
+	return keys
+}
+
+// installPatch creates the functions used by Patch
+func (d *Database) installPatch() error {
+	d.mu.RLock()
+	ready := d.patchReady
+	d.mu.RUnlock()
+	if ready {
+		return nil
+	}
+	err := d.inTransaction(context.Background(), d.db, func(tx *sql.Tx) error {
+		for _, fn := range []string{mergePatchFunction, pointerFunction, patchGetFunction, patchAddFunction, jsonPatchFunction} {
+			if _, err := tx.Exec(fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.patchReady = true
+	d.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,343 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type (
+	Op string
+
+	// Filter compares the value found at Path (inside the document body)
+	// with Value, using the operator Op
+	Filter struct {
+		Path  []string
+		Op    Op
+		Value interface{}
+	}
+
+	// Query select documents from a table using filters over the
+	// properties of the document.
+	//
+	// Equality filters over string values use the same expression
+	// created by Database.CreateIndex, so they can use those indexes.
+	Query struct {
+		runner queryRunner
+		filter []Filter
+		order  []orderBy
+		limit  int
+		offset int
+	}
+
+	orderBy struct {
+		path []string
+		desc bool
+	}
+
+	// queryRunner executes queries, implemented by each store
+	queryRunner interface {
+		runQuery(ctx context.Context, q *Query) Iterator
+	}
+)
+
+const (
+	Equals        = Op("=")
+	NotEqual      = Op("!=")
+	Greater       = Op(">")
+	Less          = Op("<")
+	GreaterEquals = Greater + Equals
+	LessEquals    = Less + Equals
+	// Value must be a slice with the accepted values
+	In = Op("in")
+	// Value must be a string using the SQL like syntax
+	Like = Op("like")
+	// Value is ignored, only checks if the path is present
+	Exists = Op("exists")
+	// Value is a json fragment (or a value encoded as json) that must
+	// be contained by the property, an empty path means the whole
+	// document. Uses GIN indexes when the body is jsonb.
+	Contains = Op("@>")
+)
+
+var (
+	errEmptyPath        = errors.New("filter without a property path")
+	errInvalidOp        = errors.New("invalid filter operator")
+	errUnsupportedValue = errors.New("filter value type is not supported")
+	errInNeedsSlice     = errors.New("the in operator requires a slice value")
+	errLikeNeedsString  = errors.New("the like operator requires a string value")
+
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// Find starts a new query over the documents of this table
+func (t *Table) Find() *Query {
+	return &Query{runner: t}
+}
+
+// Where adds a filter that compares the property at the given
+// path with val.
+func (q *Query) Where(op Op, val interface{}, propPath ...string) *Query {
+	return q.AddFilter(Filter{Path: propPath, Op: op, Value: val})
+}
+
+func (q *Query) AddFilter(f Filter) *Query {
+	q.filter = append(q.filter, f)
+	return q
+}
+
+// Contains return the documents that contain the given json fragment,
+// fragment can be a []byte/json.RawMessage with the encoded json or
+// any value that will be encoded.
+func (t *Table) Contains(fragment interface{}) Iterator {
+	return t.Find().Where(Contains, fragment).Iter()
+}
+
+// OrderBy sort the results by the text value of the given path
+func (q *Query) OrderBy(propPath ...string) *Query {
+	q.order = append(q.order, orderBy{propPath, false})
+	return q
+}
+
+// OrderByDesc is like OrderBy but using descending order
+func (q *Query) OrderByDesc(propPath ...string) *Query {
+	q.order = append(q.order, orderBy{propPath, true})
+	return q
+}
+
+// Limit the number of documents returned, zero means no limit
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Offset skip the first n documents
+func (q *Query) Offset(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// Iter execute the query and return an iterator over the
+// documents found.
+func (q *Query) Iter() Iterator {
+	return q.IterContext(context.Background())
+}
+
+func (q *Query) IterContext(ctx context.Context) Iterator {
+	return q.runner.runQuery(ctx, q)
+}
+
+func (t *Table) runQuery(ctx context.Context, q *Query) Iterator {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "select body from %v where %v", t.name, notExpired)
+	params, err := t.writeWhere(buf, q)
+	if err != nil {
+		return errIter{err}
+	}
+	q.writeOrder(buf)
+	if q.limit > 0 {
+		fmt.Fprintf(buf, " limit %d", q.limit)
+	}
+	if q.offset > 0 {
+		fmt.Fprintf(buf, " offset %d", q.offset)
+	}
+	rows, err := t.db.QueryContext(ctx, string(buf.Bytes()), params...)
+	if err != nil {
+		return errIter{err}
+	}
+	return newIterator(rows, t.owner)
+}
+
+// writeWhere appends the filters of q to a query that already has a
+// where clause
+func (t *Table) writeWhere(buf *bytes.Buffer, q *Query) ([]interface{}, error) {
+	if q == nil || len(q.filter) == 0 {
+		return nil, nil
+	}
+	if q.comparesTimestamps() {
+		if err := t.owner.installTimestamp(t.db); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprintf(buf, " and ")
+	return q.writeFilter(buf, nil)
+}
+
+// comparesTimestamps return if a filter of q casts the values with
+// pgdoc_ts
+func (q *Query) comparesTimestamps() bool {
+	for _, f := range q.filter {
+		val := f.Value
+		if rval := reflect.ValueOf(val); f.Op == In && rval.Kind() == reflect.Slice && rval.Len() > 0 {
+			val = rval.Index(0).Interface()
+		}
+		if cast, _ := castFor(val); cast == "timestamptz" && f.Op != Contains && f.Op != Like {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFilter writes all filters joined by and
+func (q *Query) writeFilter(buf *bytes.Buffer, params []interface{}) ([]interface{}, error) {
+	for i, f := range q.filter {
+		if i > 0 {
+			fmt.Fprintf(buf, " and ")
+		}
+		var err error
+		params, err = f.writeTo(buf, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+func (q *Query) writeOrder(buf *bytes.Buffer) {
+	for i, o := range q.order {
+		if i == 0 {
+			fmt.Fprintf(buf, " order by ")
+		} else {
+			fmt.Fprintf(buf, ", ")
+		}
+		fmt.Fprintf(buf, "%v", textPath(o.path))
+		if o.desc {
+			fmt.Fprintf(buf, " desc")
+		}
+	}
+}
+
+func (f *Filter) writeTo(buf *bytes.Buffer, params []interface{}) ([]interface{}, error) {
+	if f.Op == Contains {
+		params = append(params, fragmentString(f.Value))
+		// a cast from jsonb to jsonb is removed by postgresql, so GIN
+		// indexes are still used
+		if len(f.Path) == 0 {
+			fmt.Fprintf(buf, "(body::jsonb @> $%v::jsonb)", len(params))
+		} else {
+			fmt.Fprintf(buf, "((%v)::jsonb @> $%v::jsonb)", jsonPath(f.Path), len(params))
+		}
+		return params, nil
+	}
+	if len(f.Path) == 0 {
+		return nil, errEmptyPath
+	}
+	switch f.Op {
+	case Exists:
+		fmt.Fprintf(buf, "(%v is not null)", jsonPath(f.Path))
+		return params, nil
+	case Like:
+		if _, ok := f.Value.(string); !ok {
+			return nil, errLikeNeedsString
+		}
+		params = append(params, f.Value)
+		fmt.Fprintf(buf, "(%v like $%v)", textPath(f.Path), len(params))
+		return params, nil
+	case In:
+		rval := reflect.ValueOf(f.Value)
+		if rval.Kind() != reflect.Slice {
+			return nil, errInNeedsSlice
+		}
+		if rval.Len() == 0 {
+			fmt.Fprintf(buf, "false")
+			return params, nil
+		}
+		cast, err := castFor(rval.Index(0).Interface())
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, "(%v in (", castPath(f.Path, cast))
+		for i := 0; i < rval.Len(); i++ {
+			if i > 0 {
+				fmt.Fprintf(buf, ", ")
+			}
+			params = append(params, rval.Index(i).Interface())
+			fmt.Fprintf(buf, "$%v", len(params))
+		}
+		fmt.Fprintf(buf, "))")
+		return params, nil
+	case Equals, NotEqual, Greater, Less, GreaterEquals, LessEquals:
+		cast, err := castFor(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, f.Value)
+		fmt.Fprintf(buf, "(%v %v $%v)", castPath(f.Path, cast), f.Op, len(params))
+		return params, nil
+	}
+	return nil, errInvalidOp
+}
+
+func fragmentString(val interface{}) string {
+	switch val := val.(type) {
+	case json.RawMessage:
+		return string(val)
+	case []byte:
+		return string(val)
+	}
+	return jsonCol{val, nil}.plain()
+}
+
+// castFor return the postgresql type used to compare the text
+// extracted from the document with the given value.
+//
+// An empty string means that no cast is needed.
+func castFor(val interface{}) (string, error) {
+	rval := reflect.ValueOf(val)
+	switch rval.Kind() {
+	case reflect.String:
+		return "", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "numeric", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Struct:
+		if rval.Type() == timeType {
+			return "timestamptz", nil
+		}
+	}
+	return "", errUnsupportedValue
+}
+
+func castPath(propPath []string, cast string) string {
+	switch cast {
+	case "":
+		return textPath(propPath)
+	case "timestamptz":
+		// see tsFunction
+		return fmt.Sprintf("pgdoc_ts(%v)", textPath(propPath))
+	}
+	return fmt.Sprintf("(%v)::%v", textPath(propPath), cast)
+}
+
+// textPath return the expression that extracts the given path as text,
+// this is the same expression used by indexes.
+func textPath(propPath []string) string {
+	return fmt.Sprintf("body#>>'%v'", pathLiteral(propPath))
+}
+
+// jsonPath return the expression that extracts the given path as json
+func jsonPath(propPath []string) string {
+	return fmt.Sprintf("body#>'%v'", pathLiteral(propPath))
+}
+
+// pathLiteral format the path as a postgresql text array, quoting
+// the elements when needed. The value is safe to be used inside
+// a single quoted string.
+func pathLiteral(propPath []string) string {
+	parts := make([]string, len(propPath))
+	for i, p := range propPath {
+		if len(p) == 0 || strings.ContainsAny(p, `{},"\ `) {
+			p = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+		}
+		parts[i] = strings.Replace(p, "'", "''", -1)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -33,6 +33,95 @@ func (r *R) SetField(val interface{}, name string, nval interface{}) {
 	fval.Set(reflect.ValueOf(nval))
 }
 
+// SetFieldOrTag is like SetField but looks for the tag first,
+// numbers are converted to the type of the field.
+//
+// Returns false if the field don't exist or nval can't be assigned
+// to it
+func (r *R) SetFieldOrTag(val interface{}, name string, tag string, nval interface{}) bool {
+	fval := r.fieldByTag(reflect.ValueOf(val), tag)
+	if fval == zeroValue {
+		fval = r.fieldByName(reflect.ValueOf(val), name)
+	}
+	return assign(fval, nval)
+}
+
+// SetTag is like SetFieldOrTag but only sets the field with the tag
+func (r *R) SetTag(val interface{}, tag string, nval interface{}) bool {
+	return assign(r.fieldByTag(reflect.ValueOf(val), tag), nval)
+}
+
+func assign(fval reflect.Value, nval interface{}) bool {
+	rval := reflect.ValueOf(nval)
+	if fval == zeroValue || !rval.IsValid() {
+		return false
+	}
+	if rval.Type() != fval.Type() && isNumber(rval.Kind()) && isNumber(fval.Kind()) {
+		rval = rval.Convert(fval.Type())
+	}
+	if !rval.Type().AssignableTo(fval.Type()) {
+		return false
+	}
+	fval.Set(rval)
+	return true
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Elems return a pointer to each element of the given slice, if
+// the elements are already pointers they are returned as is.
+//
+// Returns false if val isn't a slice (or a pointer to one)
+func (r *R) Elems(val interface{}) ([]interface{}, bool) {
+	rval := reflect.Indirect(reflect.ValueOf(val))
+	if rval.Kind() != reflect.Slice {
+		return nil, false
+	}
+	out := make([]interface{}, rval.Len())
+	for i := range out {
+		el := rval.Index(i)
+		if el.Kind() != reflect.Ptr && el.Kind() != reflect.Interface {
+			el = el.Addr()
+		}
+		out[i] = el.Interface()
+	}
+	return out, true
+}
+
+// NewElem return a pointer to a new element of the slice pointed by
+// val, use Append to add it to the slice.
+//
+// Returns false if val isn't a pointer to a slice
+func (r *R) NewElem(val interface{}) (interface{}, bool) {
+	rval := reflect.ValueOf(val)
+	if rval.Kind() != reflect.Ptr || rval.Elem().Kind() != reflect.Slice {
+		return nil, false
+	}
+	et := rval.Elem().Type().Elem()
+	if et.Kind() == reflect.Ptr {
+		return reflect.New(et.Elem()).Interface(), true
+	}
+	return reflect.New(et).Interface(), true
+}
+
+// Append adds elem, created by NewElem, to the slice pointed by val
+func (r *R) Append(val interface{}, elem interface{}) {
+	slice := reflect.ValueOf(val).Elem()
+	ev := reflect.ValueOf(elem)
+	if slice.Type().Elem().Kind() != reflect.Ptr {
+		ev = ev.Elem()
+	}
+	slice.Set(reflect.Append(slice, ev))
+}
+
 func (r *R) GetTypeName(val interface{}) (pkg string, name string) {
 	tp := reflect.TypeOf(val)
 	if tp.Kind() == reflect.Ptr {
@@ -67,6 +156,13 @@ func (r *R) HasField(val interface{}, name string) bool {
 	return true
 }
 
+func (r *R) HasFieldOrTag(val interface{}, name string, tag string) bool {
+	if r.fieldByTag(reflect.ValueOf(val), tag) != zeroValue {
+		return true
+	}
+	return r.HasField(val, name)
+}
+
 func (r *R) fieldByTag(val reflect.Value, tag string) reflect.Value {
 	tc := r.ensureTypeCached(val.Type())
 	if fld, has := tc.fieldByTag[tag]; has {
@@ -0,0 +1,211 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+type (
+	// OnDelete is what happens with the links of a document when it
+	// is deleted, see Link.Bind
+	OnDelete string
+
+	// DanglingLinkError is returned when a bound link points to a
+	// document that doesn't exist
+	DanglingLinkError struct {
+		Link string
+		// From or To
+		Endpoint string
+		// empty when Bind finds existing links to missing documents
+		Id string
+	}
+
+	// ReferencedError is returned when a document can't be deleted
+	// because a link bound with Restrict points to it
+	ReferencedError struct {
+		Table string
+		// empty for DeleteWhere
+		Id   string
+		Link string
+	}
+)
+
+const (
+	// Delete the links
+	Cascade = OnDelete("cascade")
+	// Don't allow the document to be deleted, ReferencedError is
+	// returned
+	Restrict = OnDelete("restrict")
+	// Keep the links but set the endpoint to null, the body of the
+	// link isn't changed
+	Nullify = OnDelete("set null")
+
+	foreignKeyViolation = "23503"
+)
+
+func (e *DanglingLinkError) Error() string {
+	if len(e.Id) == 0 {
+		return fmt.Sprintf("%v: %v points to a missing document", e.Link, e.Endpoint)
+	}
+	return fmt.Sprintf("%v: %v %v doesn't exist", e.Link, e.Endpoint, e.Id)
+}
+
+func (e *ReferencedError) Error() string {
+	if len(e.Id) == 0 {
+		return fmt.Sprintf("%v: documents are referenced by %v", e.Table, e.Link)
+	}
+	return fmt.Sprintf("%v: %v is referenced by %v", e.Table, e.Id, e.Link)
+}
+
+// Bind makes the database check that From points to a document of
+// the from table and To to a document of the to table, a nil table
+// don't check the endpoint. Connect returns a DanglingLinkError for
+// links to missing documents.
+//
+// onDelete controls what happens with the links when a document is
+// deleted.
+//
+// Binding again replaces the previous constraints, the endpoints
+// are nullable only while they are bound with Nullify. Fails if
+// existing links point to missing documents or have null endpoints
+// that onDelete doesn't allow.
+func (l *Link) Bind(from, to *Table, onDelete OnDelete) error {
+	return l.BindContext(context.Background(), from, to, onDelete)
+}
+
+func (l *Link) BindContext(ctx context.Context, from, to *Table, onDelete OnDelete) error {
+	switch onDelete {
+	case Cascade, Restrict, Nullify:
+	default:
+		return fmt.Errorf("invalid OnDelete %q", onDelete)
+	}
+	var fromName, toName *string
+	if from != nil {
+		fromName = &from.name
+	}
+	if to != nil {
+		toName = &to.name
+	}
+	err := l.owner.inTransaction(ctx, l.db, func(tx *sql.Tx) error {
+		return bind(ctx, tx, l.name, fromName, toName, onDelete)
+	})
+	return danglingError(err, "", "")
+}
+
+// bind creates the constraints of Bind on link, a nil table don't
+// change the endpoint
+func bind(ctx context.Context, tx *sql.Tx, link string, from, to *string, onDelete OnDelete) error {
+	for _, end := range []struct {
+		col   string
+		table *string
+	}{{"_from", from}, {"_to", to}} {
+		if end.table == nil {
+			continue
+		}
+		fk := fmt.Sprintf("fk_%v%v", link, end.col)
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %v drop constraint if exists %v", link, fk)); err != nil {
+			return err
+		}
+		null := "set not null"
+		if onDelete == Nullify {
+			null = "drop not null"
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %v alter column %v %v", link, end.col, null)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %v add constraint %v foreign key (%v) references %v (docid) on delete %v",
+			link, fk, end.col, *end.table, onDelete)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// binding return the tables bound to the endpoints of link, nil for
+// the endpoints that aren't bound, and the OnDelete of the constraints
+func binding(ctx context.Context, db querier, link string) (from, to *string, onDelete OnDelete, err error) {
+	rows, err := db.QueryContext(ctx, `select c.conname, r.relname, c.confdeltype from pg_constraint c
+		join pg_class r on r.oid = c.confrelid
+		where c.conrelid = $1::regclass and c.contype = 'f' and c.conname in ($2, $3)`,
+		link, fmt.Sprintf("fk_%v_from", link), fmt.Sprintf("fk_%v_to", link))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, table, action string
+		if err = rows.Scan(&name, &table, &action); err != nil {
+			return nil, nil, "", err
+		}
+		if name == fmt.Sprintf("fk_%v_from", link) {
+			from = &table
+		} else {
+			to = &table
+		}
+		switch action {
+		case "c":
+			onDelete = Cascade
+		case "n":
+			onDelete = Nullify
+		default:
+			onDelete = Restrict
+		}
+	}
+	return from, to, onDelete, rows.Err()
+}
+
+// Unbind removes the constraints created by Bind
+func (l *Link) Unbind() error {
+	for _, col := range []string{"_from", "_to"} {
+		if _, err := l.db.Exec(fmt.Sprintf("alter table %v drop constraint if exists fk_%v%v", l.name, l.name, col)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindEndpoint return the link and the endpoint (From or To) of the
+// constraint created by Bind that caused the foreign key violation
+// err, empty if err is something else.
+//
+// Violations are reported on the link for both inserts and deletes,
+// so the constraint name is enough to find the endpoint.
+func bindEndpoint(err error) (string, string) {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != foreignKeyViolation {
+		return "", ""
+	}
+	switch pqErr.Constraint {
+	case fmt.Sprintf("fk_%v_from", pqErr.Table):
+		return pqErr.Table, "From"
+	case fmt.Sprintf("fk_%v_to", pqErr.Table):
+		return pqErr.Table, "To"
+	}
+	return "", ""
+}
+
+// danglingError converts the violations caused by saving a link from
+// from to to into a DanglingLinkError, other errors are returned as
+// is.
+func danglingError(err error, from, to string) error {
+	link, endpoint := bindEndpoint(err)
+	switch endpoint {
+	case "From":
+		return &DanglingLinkError{Link: link, Endpoint: endpoint, Id: from}
+	case "To":
+		return &DanglingLinkError{Link: link, Endpoint: endpoint, Id: to}
+	}
+	return err
+}
+
+// referencedError converts the violations caused by deleting the
+// document id of table into a ReferencedError, other errors are
+// returned as is.
+func referencedError(err error, table, id string) error {
+	if link, endpoint := bindEndpoint(err); len(endpoint) > 0 {
+		return &ReferencedError{Table: table, Id: id, Link: link}
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package pgdoc
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"reflect"
+	"testing"
+)
+
+func TestRefError(t *testing.T) {
+	// the detail is ignored, it depends on the language of the server
+	dangling := &pq.Error{
+		Code:       foreignKeyViolation,
+		Detail:     `Schlüssel (_to)=(bob) ist nicht in Tabelle "people" vorhanden.`,
+		Table:      "friends",
+		Constraint: "fk_friends_to",
+	}
+	expected := &DanglingLinkError{Link: "friends", Endpoint: "To", Id: "bob"}
+	if err := danglingError(dangling, "ann", "bob"); !reflect.DeepEqual(err, expected) {
+		t.Errorf("expecting %v got %v", expected, err)
+	}
+
+	referenced := &pq.Error{
+		Code:       foreignKeyViolation,
+		Table:      "friends",
+		Constraint: "fk_friends_from",
+	}
+	expectedRef := &ReferencedError{Table: "people", Id: "ann", Link: "friends"}
+	if err := referencedError(referenced, "people", "ann"); !reflect.DeepEqual(err, expectedRef) {
+		t.Errorf("expecting %v got %v", expectedRef, err)
+	}
+
+	other := &pq.Error{Code: foreignKeyViolation, Table: "orders", Constraint: "orders_customer_fkey"}
+	if err := danglingError(other, "ann", "bob"); err != other {
+		t.Errorf("constraints not created by Bind should be kept, got %v", err)
+	}
+	// a constraint named like Bind but on another table
+	prefixed := &pq.Error{Code: foreignKeyViolation, Table: "orders", Constraint: "fk_friends_to"}
+	if err := referencedError(prefixed, "people", "ann"); err != prefixed {
+		t.Errorf("constraints not created by Bind should be kept, got %v", err)
+	}
+	plain := errors.New("some error")
+	if err := danglingError(plain, "ann", "bob"); err != plain {
+		t.Errorf("expecting %v got %v", plain, err)
+	}
+	if err := referencedError(nil, "people", "ann"); err != nil {
+		t.Errorf("expecting nil got %v", err)
+	}
+}
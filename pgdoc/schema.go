@@ -0,0 +1,491 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// Schema is the subset of JSON Schema (draft 7) supported by pgdoc.
+	//
+	// Supported keywords: type, enum, const, properties, required,
+	// additionalProperties, items, minItems, maxItems, uniqueItems,
+	// minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+	// exclusiveMaximum, multipleOf, allOf, anyOf, oneOf and not.
+	//
+	// Boolean schemas (true/false) are accepted everywhere a schema is.
+	Schema struct {
+		Type                 schemaTypes        `json:"type,omitempty"`
+		Enum                 []interface{}      `json:"enum,omitempty"`
+		Const                *interface{}       `json:"const,omitempty"`
+		Properties           map[string]*Schema `json:"properties,omitempty"`
+		Required             []string           `json:"required,omitempty"`
+		AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+		Items                *Schema            `json:"items,omitempty"`
+		MinItems             *int               `json:"minItems,omitempty"`
+		MaxItems             *int               `json:"maxItems,omitempty"`
+		UniqueItems          bool               `json:"uniqueItems,omitempty"`
+		MinLength            *int               `json:"minLength,omitempty"`
+		MaxLength            *int               `json:"maxLength,omitempty"`
+		Pattern              string             `json:"pattern,omitempty"`
+		Minimum              *float64           `json:"minimum,omitempty"`
+		Maximum              *float64           `json:"maximum,omitempty"`
+		ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+		ExclusiveMaximum     *float64           `json:"exclusiveMaximum,omitempty"`
+		MultipleOf           *float64           `json:"multipleOf,omitempty"`
+		AllOf                []*Schema          `json:"allOf,omitempty"`
+		AnyOf                []*Schema          `json:"anyOf,omitempty"`
+		OneOf                []*Schema          `json:"oneOf,omitempty"`
+		Not                  *Schema            `json:"not,omitempty"`
+
+		// false boolean schema, nothing is valid
+		never   bool
+		pattern *regexp.Regexp
+	}
+
+	// schemaTypes accepts both "type": "x" and "type": ["x", "y"]
+	schemaTypes []string
+
+	// FieldError describes why the value at Path is invalid, Path
+	// is a JSON pointer (RFC 6901) relative to the document.
+	FieldError struct {
+		Path    string
+		Message string
+	}
+
+	// ValidationError is returned when a document don't match the
+	// schema registered for its table.
+	ValidationError struct {
+		Table  string
+		Errors []FieldError
+	}
+
+	// cachedSchema is a schema loaded from the metadata table, nil
+	// means that the table has no schema
+	cachedSchema struct {
+		schema *Schema
+		at     time.Time
+	}
+)
+
+const (
+	schemaMeta = "schema"
+)
+
+var (
+	// how long a schema (or its absence) is cached, schemas changed
+	// by other processes are seen after it
+	schemaCacheTTL = time.Minute
+)
+
+func (e *ValidationError) Error() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "document is invalid for %v:", e.Table)
+	for i, fe := range e.Errors {
+		if i > 0 {
+			fmt.Fprintf(buf, ";")
+		}
+		fmt.Fprintf(buf, " %v: %v", fe.Path, fe.Message)
+	}
+	return string(buf.Bytes())
+}
+
+// ParseSchema decode and compile the given JSON Schema
+func ParseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SetSchema register the JSON schema that every document saved into
+// tableOrLink must match, the schema is saved in the database so
+// every process using it will validate the documents.
+//
+// Documents already saved aren't validated.
+func (d *Database) SetSchema(tableOrLink string, schema []byte) error {
+	s, err := ParseSchema(schema)
+	if err != nil {
+		return err
+	}
+	if err := d.setMeta(tableOrLink, schemaMeta, json.RawMessage(schema)); err != nil {
+		return err
+	}
+	d.cacheSchema(tableOrLink, s)
+	return nil
+}
+
+// RemoveSchema stop validating documents saved into tableOrLink
+func (d *Database) RemoveSchema(tableOrLink string) error {
+	if err := d.deleteMeta(tableOrLink, schemaMeta); err != nil {
+		return err
+	}
+	d.cacheSchema(tableOrLink, nil)
+	return nil
+}
+
+// cacheSchema keeps s for the next documents, nil means that the
+// table has no schema
+func (d *Database) cacheSchema(tableOrLink string, s *Schema) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.schemas == nil {
+		d.schemas = make(map[string]cachedSchema)
+	}
+	d.schemas[tableOrLink] = cachedSchema{s, time.Now()}
+}
+
+// forgetSchemas removes every cached schema, they are loaded again
+// from the metadata table
+func (d *Database) forgetSchemas() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.schemas = nil
+}
+
+// schemaFor return the schema of tableOrLink, nil if it doesn't have
+// one. Schemas and their absence are cached for schemaCacheTTL.
+func (d *Database) schemaFor(ctx context.Context, db querier, tableOrLink string) (*Schema, error) {
+	d.mu.RLock()
+	c, has := d.schemas[tableOrLink]
+	d.mu.RUnlock()
+	if has && time.Since(c.at) < schemaCacheTTL {
+		return c.schema, nil
+	}
+	var raw json.RawMessage
+	var s *Schema
+	if found, err := d.getMetaOn(ctx, db, tableOrLink, schemaMeta, &raw); err != nil {
+		return nil, err
+	} else if found {
+		if s, err = ParseSchema(raw); err != nil {
+			return nil, err
+		}
+	}
+	d.cacheSchema(tableOrLink, s)
+	return s, nil
+}
+
+// encode val as json and validate it using the schema of the
+// table (if any), read through db
+func (d *Database) encode(ctx context.Context, db querier, tableOrLink string, val interface{}) (string, error) {
+	s, err := d.schemaFor(ctx, db, tableOrLink)
+	if err != nil {
+		return "", err
+	}
+	return d.encodeWith(ctx, s, tableOrLink, val)
+}
+
+// encodeWith is like encode with the schema already loaded, so bulk
+// inserts load it once
+func (d *Database) encodeWith(ctx context.Context, s *Schema, tableOrLink string, val interface{}) (string, error) {
+	// schemas validate the plain values
+	body := jsonCol{val, nil}.plain()
+	if s == nil {
+		return jsonCol{val, d}.encrypt(ctx, body)
+	}
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return "", err
+	}
+	if errs := s.Validate(doc); len(errs) > 0 {
+		return "", &ValidationError{tableOrLink, errs}
+	}
+	return jsonCol{val, d}.encrypt(ctx, body)
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*s = Schema{never: !b}
+		return nil
+	}
+	// avoid calling UnmarshalJSON again
+	type plain Schema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+func (st *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*st = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*st = schemaTypes(many)
+	return nil
+}
+
+func (s *Schema) compile() error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Pattern) > 0 {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	children := []*Schema{s.AdditionalProperties, s.Items, s.Not}
+	children = append(children, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	for _, c := range children {
+		if err := c.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate doc (as decoded by encoding/json) and return the list of
+// problems found.
+func (s *Schema) Validate(doc interface{}) []FieldError {
+	return s.validate("", normalize(doc), nil)
+}
+
+func (s *Schema) validate(path string, val interface{}, errs []FieldError) []FieldError {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if len(p) == 0 {
+			p = "/"
+		}
+		errs = append(errs, FieldError{p, fmt.Sprintf(format, args...)})
+	}
+	if s == nil {
+		return errs
+	}
+	if s.never {
+		fail("no value is allowed")
+		return errs
+	}
+	if len(s.Type) > 0 && !s.Type.match(val) {
+		fail("expecting %v got %v", strings.Join(s.Type, " or "), jsonType(val))
+		return errs
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(normalize(e), val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.Const != nil && !jsonEqual(normalize(*s.Const), val) {
+		fail("value is not the expected constant")
+	}
+
+	switch val := val.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, has := val[r]; !has {
+				fail("missing required property %v", r)
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path + "/" + escapePointer(k)
+			if ps, has := s.Properties[k]; has {
+				errs = ps.validate(child, val[k], errs)
+			} else if s.AdditionalProperties != nil {
+				if s.AdditionalProperties.never {
+					errs = append(errs, FieldError{child, "additional property is not allowed"})
+				} else {
+					errs = s.AdditionalProperties.validate(child, val[k], errs)
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			fail("should have at least %v items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			fail("should have at most %v items", *s.MaxItems)
+		}
+		if s.UniqueItems {
+			for i := range val {
+				for j := i + 1; j < len(val); j++ {
+					if jsonEqual(val[i], val[j]) {
+						fail("items %v and %v are equal", i, j)
+					}
+				}
+			}
+		}
+		for i, item := range val {
+			errs = s.Items.validate(fmt.Sprintf("%v/%v", path, i), item, errs)
+		}
+	case string:
+		length := len([]rune(val))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("should have at least %v characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("should have at most %v characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("should match the pattern %v", s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			fail("should be greater or equal to %v", *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			fail("should be less or equal to %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && val <= *s.ExclusiveMinimum {
+			fail("should be greater than %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && val >= *s.ExclusiveMaximum {
+			fail("should be less than %v", *s.ExclusiveMaximum)
+		}
+		if s.MultipleOf != nil && *s.MultipleOf != 0 {
+			if q := val / *s.MultipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("should be a multiple of %v", *s.MultipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		errs = sub.validate(path, val, errs)
+	}
+	if len(s.AnyOf) > 0 {
+		ok := false
+		for _, sub := range s.AnyOf {
+			if len(sub.validate(path, val, nil)) == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("value don't match any of the schemas in anyOf")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		count := 0
+		for _, sub := range s.OneOf {
+			if len(sub.validate(path, val, nil)) == 0 {
+				count++
+			}
+		}
+		if count != 1 {
+			fail("value should match exactly one schema in oneOf, matched %v", count)
+		}
+	}
+	if s.Not != nil && len(s.Not.validate(path, val, nil)) == 0 {
+		fail("value should not match the schema in not")
+	}
+	return errs
+}
+
+func (st schemaTypes) match(val interface{}) bool {
+	actual := jsonType(val)
+	for _, t := range st {
+		if t == actual {
+			return true
+		}
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(val interface{}) string {
+	switch val := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// normalize convert json.Number values into float64, so values can
+// be compared
+func normalize(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalize(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+	case int:
+		return float64(v)
+	}
+	return val
+}
+
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		bm, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			if other, has := bm[k]; !has || !jsonEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bs, ok := b.([]interface{})
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,83 @@
+package pgdoc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["Name", "Age"],
+		"additionalProperties": false,
+		"properties": {
+			"Id": {"type": "string"},
+			"Name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"Age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"Role": {"enum": ["admin", "user"]},
+			"Tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+			"Email": {"type": ["string", "null"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("error parsing schema: %v", err)
+	}
+
+	cases := []struct {
+		doc    string
+		errors []string
+	}{
+		{`{"Id": "1", "Name": "Bob", "Age": 30, "Role": "admin", "Tags": ["a", "b"], "Email": null}`, nil},
+		{`{"Name": "Bob"}`, []string{"/"}},
+		{`{"Name": "bob", "Age": 1.5}`, []string{"/Age", "/Name"}},
+		{`{"Name": "Bob", "Age": 200, "Role": "root"}`, []string{"/Age", "/Role"}},
+		{`{"Name": "Bob", "Age": 1, "Tags": ["a", 1, "a"]}`, []string{"/Tags", "/Tags/1"}},
+		{`{"Name": "Bob", "Age": 1, "Other/Field": true}`, []string{"/Other~1Field"}},
+	}
+
+	for _, c := range cases {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(c.doc), &doc); err != nil {
+			t.Fatalf("invalid test document %v: %v", c.doc, err)
+		}
+		var paths []string
+		for _, fe := range schema.Validate(doc) {
+			paths = append(paths, fe.Path)
+		}
+		if !reflect.DeepEqual(paths, c.errors) {
+			t.Errorf("%v: expecting errors at %v got %v", c.doc, c.errors, paths)
+		}
+	}
+}
+
+func TestSchemaBoolean(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"properties": {"Any": true, "None": false}, "not": {"required": ["Forbidden"]}}`))
+	if err != nil {
+		t.Fatalf("error parsing schema: %v", err)
+	}
+	if errs := schema.Validate(map[string]interface{}{"Any": 1}); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if errs := schema.Validate(map[string]interface{}{"None": 1}); len(errs) != 1 || errs[0].Path != "/None" {
+		t.Errorf("expecting an error at /None got %v", errs)
+	}
+	if errs := schema.Validate(map[string]interface{}{"Forbidden": 1}); len(errs) != 1 {
+		t.Errorf("expecting an error from not got %v", errs)
+	}
+}
+
+func TestSchemaCache(t *testing.T) {
+	d := WrapDB(nil)
+	s, _ := ParseSchema([]byte(`{"type": "object"}`))
+	d.cacheSchema("docs", s)
+	d.cacheSchema("other", nil)
+	// a nil querier panics if the metadata table is read
+	if got, err := d.schemaFor(context.Background(), nil, "docs"); err != nil || got != s {
+		t.Errorf("expecting the cached schema got %v: %v", got, err)
+	}
+	if got, err := d.schemaFor(context.Background(), nil, "other"); err != nil || got != nil {
+		t.Errorf("expecting the cached absence got %v: %v", got, err)
+	}
+}
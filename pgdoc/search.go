@@ -0,0 +1,236 @@
+package pgdoc
+
+import (
+	"amoraes.info/pgdoc/reflector"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+type (
+	// textIndex is the definition of a full text index, saved in the
+	// metadata table so Search can build the same expression used by
+	// the index.
+	textIndex struct {
+		Language string
+		Paths    [][]string
+	}
+
+	// TextSearch is a full text search over a table, created by
+	// Table.Search.
+	//
+	// When scanning the results, fields tagged with `pgdoc:"Rank"`
+	// receive the rank of the document and fields tagged with
+	// `pgdoc:"Highlight"` receive the highlighted text, if requested.
+	TextSearch struct {
+		table     *Table
+		index     string
+		query     string
+		highlight bool
+		limit     int
+		offset    int
+	}
+
+	searchIter struct {
+		rows      *sql.Rows
+		reflector *reflector.R
+		owner     *Database
+		highlight bool
+	}
+)
+
+const (
+	textMeta     = "text"
+	rankTag      = `pgdoc:"Rank"`
+	highlightTag = `pgdoc:"Highlight"`
+)
+
+var (
+	errNoTextIndex        = errors.New("table has no text index")
+	errAmbiguousTextIndex = errors.New("table has more than one text index, use TextSearch.Index")
+	errTextWithoutPath    = errors.New("text indexes require at least one property path")
+)
+
+// CreateTextIndex creates a full text index over the text of the
+// given property paths, using the text search configuration of
+// language (english, portuguese, simple, ...). An empty language
+// uses simple.
+func (d *Database) CreateTextIndex(table, idxName, language string, paths ...[]string) error {
+	if len(paths) == 0 {
+		return errTextWithoutPath
+	}
+	if exists, err := d.indexExistsOn(table, idxName); err != nil {
+		return err
+	} else if exists {
+		return ErrIndexAlreadyExists
+	}
+	if len(language) == 0 {
+		language = "simple"
+	}
+	idx := textIndex{language, paths}
+	if _, err := d.db.Exec(fmt.Sprintf("CREATE INDEX idx_%v_%v on %v using gin ((%v));", table, idxName, table, idx.vector())); err != nil {
+		return err
+	}
+	indexes, err := d.textIndexes(context.Background(), table)
+	if err != nil {
+		return err
+	}
+	indexes[idxName] = idx
+	return d.setMeta(table, textMeta, indexes)
+}
+
+// DropTextIndex removes an index created by CreateTextIndex
+func (d *Database) DropTextIndex(table, idxName string) error {
+	if err := d.dropIndex(table, idxName); err != nil {
+		return err
+	}
+	indexes, err := d.textIndexes(context.Background(), table)
+	if err != nil {
+		return err
+	}
+	delete(indexes, idxName)
+	return d.setMeta(table, textMeta, indexes)
+}
+
+func (d *Database) textIndexes(ctx context.Context, table string) (map[string]textIndex, error) {
+	indexes := make(map[string]textIndex)
+	if _, err := d.getMeta(ctx, table, textMeta, &indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// text return the expression with the text of every path
+func (ti textIndex) text() string {
+	parts := make([]string, len(ti.Paths))
+	for i, p := range ti.Paths {
+		parts[i] = fmt.Sprintf("coalesce(%v, '')", textPath(p))
+	}
+	return strings.Join(parts, " || ' ' || ")
+}
+
+func (ti textIndex) config() string {
+	return pq.QuoteLiteral(ti.Language) + "::regconfig"
+}
+
+// vector return the expression used by the index
+func (ti textIndex) vector() string {
+	return fmt.Sprintf("to_tsvector(%v, %v)", ti.config(), ti.text())
+}
+
+// Search documents whose text match query, query uses the syntax of
+// web search engines: words, "quoted phrases", or and -word.
+//
+// Results are sorted from the best to the worst match.
+func (t *Table) Search(query string) *TextSearch {
+	return &TextSearch{table: t, query: query}
+}
+
+// Index select which text index is used, only required if the table
+// has more than one.
+func (s *TextSearch) Index(name string) *TextSearch {
+	s.index = name
+	return s
+}
+
+// Highlight fills the fields tagged with `pgdoc:"Highlight"` with
+// fragments of the text where the matched words are inside <b></b>
+func (s *TextSearch) Highlight() *TextSearch {
+	s.highlight = true
+	return s
+}
+
+func (s *TextSearch) Limit(n int) *TextSearch {
+	s.limit = n
+	return s
+}
+
+func (s *TextSearch) Offset(n int) *TextSearch {
+	s.offset = n
+	return s
+}
+
+func (s *TextSearch) Iter() Iterator {
+	return s.IterContext(context.Background())
+}
+
+func (s *TextSearch) IterContext(ctx context.Context) Iterator {
+	t := s.table
+	indexes, err := t.owner.textIndexes(ctx, t.name)
+	if err != nil {
+		return errIter{err}
+	}
+	idx, has := indexes[s.index]
+	if len(s.index) == 0 {
+		if len(indexes) > 1 {
+			return errIter{errAmbiguousTextIndex}
+		}
+		for _, idx = range indexes {
+			has = true
+		}
+	}
+	if !has {
+		return errIter{errNoTextIndex}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "select body, ts_rank(%v, q) as rank", idx.vector())
+	if s.highlight {
+		fmt.Fprintf(buf, ", ts_headline(%v, %v, q)", idx.config(), idx.text())
+	}
+	fmt.Fprintf(buf, " from %v, websearch_to_tsquery(%v, $1) q where %v @@ q and %v order by rank desc", t.name, idx.config(), idx.vector(), notExpired)
+	if s.limit > 0 {
+		fmt.Fprintf(buf, " limit %d", s.limit)
+	}
+	if s.offset > 0 {
+		fmt.Fprintf(buf, " offset %d", s.offset)
+	}
+	rows, err := t.db.QueryContext(ctx, string(buf.Bytes()), s.query)
+	if err != nil {
+		return errIter{err}
+	}
+	return &searchIter{rows, &t.owner.reflector, t.owner, s.highlight}
+}
+
+func (s *searchIter) Next() bool {
+	return s.rows.Next()
+}
+
+func (s *searchIter) Err() error {
+	return s.rows.Err()
+}
+
+func (s *searchIter) Close() error {
+	return s.rows.Close()
+}
+
+func (s *searchIter) Scan(out interface{}) error {
+	if !s.reflector.IsPtr(out) {
+		return errValNotAPointer
+	}
+	jc := jsonCol{out, s.owner}
+	var rank float64
+	var highlight string
+	var err error
+	if s.highlight {
+		err = s.rows.Scan(&jc, &rank, &highlight)
+	} else {
+		err = s.rows.Scan(&jc, &rank)
+	}
+	if err != nil {
+		return err
+	}
+	s.reflector.SetTag(out, rankTag, rank)
+	if s.highlight {
+		s.reflector.SetTag(out, highlightTag, highlight)
+	}
+	return nil
+}
+
+func (s *searchIter) ScanAll(out interface{}) error {
+	return scanAll(s, s.reflector, out)
+}
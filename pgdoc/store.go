@@ -0,0 +1,78 @@
+package pgdoc
+
+import (
+	"context"
+)
+
+type (
+	// Store is the API shared by Database and MemoryStore, code that
+	// only needs documents, links and indexes should depend on Store
+	// so it can be tested without postgresql.
+	Store interface {
+		OpenTable(name string) (TableStore, error)
+		OpenLink(name string) (LinkStore, error)
+		Unique(tableOrLink string, idxName string, propPath ...string) error
+		CreateIndex(tableOrLink string, idxName string, propPath ...string) error
+		DropIndex(tableOrLink string, idxName string) error
+		CascadeLinks(table string, links ...string)
+		SetIDGenerator(g IDGenerator)
+		Truncate(tblOrLink string) error
+		Close() error
+	}
+
+	// TableStore is the API shared by Table and the tables of a
+	// MemoryStore
+	TableStore interface {
+		Name() string
+		Load(out interface{}, id string) error
+		LoadContext(ctx context.Context, out interface{}, id string) error
+		Save(val interface{}) (string, error)
+		SaveContext(ctx context.Context, val interface{}) (string, error)
+		SaveMany(docs interface{}) error
+		Delete(id string) error
+		DeleteContext(ctx context.Context, id string) error
+		DeleteWhere(q *Query) (int64, error)
+		Find() *Query
+		Contains(fragment interface{}) Iterator
+	}
+
+	// LinkStore is the API shared by Link and the links of a
+	// MemoryStore
+	LinkStore interface {
+		Name() string
+		Load(out interface{}, id string) error
+		LoadContext(ctx context.Context, out interface{}, id string) error
+		From(from string) Iterator
+		To(to string) Iterator
+		Label(label string) Iterator
+		LoadMany(from, to, label string) Iterator
+		LoadManyContext(ctx context.Context, from, to, label string) Iterator
+		Connect(val interface{}) (string, error)
+		ConnectContext(ctx context.Context, val interface{}) (string, error)
+		ConnectMany(edges interface{}) error
+	}
+)
+
+var (
+	_ Store      = (*Database)(nil)
+	_ TableStore = (*Table)(nil)
+	_ LinkStore  = (*Link)(nil)
+)
+
+// OpenTable is like Table but returns a TableStore
+func (d *Database) OpenTable(name string) (TableStore, error) {
+	t, err := d.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenLink is like Link but returns a LinkStore
+func (d *Database) OpenLink(name string) (LinkStore, error) {
+	l, err := d.Link(name)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
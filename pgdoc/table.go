@@ -1,76 +1,248 @@
 package pgdoc
 
 import (
+	"amoraes.info/pgdoc/reflector"
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"reflect"
+	"strings"
 )
 
 func (t *Table) Name() string {
 	return t.name
 }
 
+// Load the document with the given id into out, if out has a
+// revision field (Rev or tagged with pgdoc:"Rev") it is populated
+// with the current revision of the document.
 func (t *Table) Load(out interface{}, id string) error {
+	return t.LoadContext(context.Background(), out, id)
+}
+
+func (t *Table) LoadContext(ctx context.Context, out interface{}, id string) error {
 	if !t.owner.reflector.IsPtr(out) {
 		return errValNotAPointer
 	}
-	return t.query(out, id)
+	return t.query(ctx, out, id)
 }
 
 // Save will put the given object in the table.
+//
+// If val has a revision field, the document is only updated when
+// the revision matches the one stored in the database, otherwise
+// ErrConflict is returned. After a successful Save the revision
+// field holds the new revision.
+//
+// Objects without a revision field always overwrite the stored
+// document.
 func (t *Table) Save(val interface{}) (string, error) {
-	r := t.owner.reflector
+	return t.SaveContext(context.Background(), val)
+}
+
+func (t *Table) SaveContext(ctx context.Context, val interface{}) (string, error) {
+	r := &t.owner.reflector
 	if !r.IsPtr(val) {
 		return "", errValNotAPointer
 	}
 	var id string
 	if r.HasField(val, "Id") {
-		previd := r.GetField(val, "Id", "").(string)
-		if len(previd) == 0 {
-			id = t.newId()
-			return t.insert(id, val)
-		} else {
-			if exists, err := t.docExists(id); err != nil {
-				return "", err
-			} else {
-				if exists {
-					return t.insert(id, val)
-				} else {
-					return t.update(id, val)
-				}
-			}
+		id = r.GetField(val, "Id", "").(string)
+	}
+	if len(id) == 0 {
+		nid, err := t.newId()
+		if err != nil {
+			return "", err
 		}
+		return t.insert(ctx, nid, val)
 	}
-	return t.insert(id, val)
+	if exists, err := t.docExists(ctx, id); err != nil {
+		return "", err
+	} else if !exists {
+		return t.insert(ctx, id, val)
+	}
+	return t.update(ctx, id, val)
 }
 
-func (t *Table) newId() string {
+func (t *Table) newId() (string, error) {
 	return t.owner.newId(t.name)
 }
 
-func (t *Table) insert(nid string, val interface{}) (string, error) {
-	t.owner.reflector.SetField(val, "Id", nid)
-	_, err := t.owner.db.Exec(fmt.Sprintf("insert into %v (docid, body) values ($1, $2)", t.name), nid, jsonCol{val}.String())
-	if t.owner.reflector.HasField(val, "Id") {
-		t.owner.reflector.SetField(val, "Id", nid)
+func (t *Table) insert(ctx context.Context, nid string, val interface{}) (string, error) {
+	r := &t.owner.reflector
+	if r.HasField(val, "Id") {
+		r.SetField(val, "Id", nid)
+	}
+	r.SetFieldOrTag(val, "Rev", revTag, int64(1))
+	body, err := t.owner.encode(ctx, t.db, t.name, val)
+	if err != nil {
+		return "", err
 	}
+	expires, err := t.expiration(ctx, val)
+	if err != nil {
+		return "", err
+	}
+	_, err = t.db.ExecContext(ctx, fmt.Sprintf("insert into %v (docid, rev, body, expires_at) values ($1, 1, $2, $3)", t.name), nid, body, expires)
 	return nid, err
 }
 
-func (t *Table) update(nid string, val interface{}) (string, error) {
-	_, err := t.owner.db.Exec(fmt.Sprintf("update %v set body = $2 where docid = $1", nid, jsonCol{val}.String()))
+func (t *Table) update(ctx context.Context, nid string, val interface{}) (string, error) {
+	r := &t.owner.reflector
+	expires, err := t.expiration(ctx, val)
+	if err != nil {
+		return "", err
+	}
+	prev, hasRev := revOf(r, val)
+	if !hasRev {
+		body, err := t.owner.encode(ctx, t.db, t.name, val)
+		if err != nil {
+			return "", err
+		}
+		_, err = t.db.ExecContext(ctx, fmt.Sprintf("update %v set body = $2, rev = rev + 1, expires_at = $3 where docid = $1", t.name), nid, body, expires)
+		return nid, err
+	}
+	// the body should carry the revision it will have after the update
+	r.SetFieldOrTag(val, "Rev", revTag, prev+1)
+	body, err := t.owner.encode(ctx, t.db, t.name, val)
+	if err != nil {
+		r.SetFieldOrTag(val, "Rev", revTag, prev)
+		return "", err
+	}
+	res, err := t.db.ExecContext(ctx, fmt.Sprintf("update %v set body = $2, rev = rev + 1, expires_at = $4 where docid = $1 and rev = $3", t.name), nid, body, prev, expires)
+	if err == nil {
+		var count int64
+		count, err = res.RowsAffected()
+		if err == nil && count == 0 {
+			err = ErrConflict
+		}
+	}
+	if err != nil {
+		r.SetFieldOrTag(val, "Rev", revTag, prev)
+	}
 	return nid, err
 }
 
-func (t *Table) query(out interface{}, id string) error {
-	return t.owner.db.QueryRow(fmt.Sprintf("select body from %v where docid = $1", t.name), id).Scan(&jsonCol{out})
+func (t *Table) query(ctx context.Context, out interface{}, id string) error {
+	var rev int64
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("select body, rev from %v where docid = $1 and %v", t.name, notExpired), id).Scan(&jsonCol{out, t.owner}, &rev)
+	if err != nil {
+		return err
+	}
+	t.owner.reflector.SetFieldOrTag(out, "Rev", revTag, rev)
+	return nil
+}
+
+// revKey return the json key of the revision field of tp, Rev if tp
+// is nil or don't have one
+func revKey(tp reflect.Type) string {
+	for tp != nil && tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if tp == nil || tp.Kind() != reflect.Struct {
+		return "Rev"
+	}
+	var byName *reflect.StructField
+	for i := 0; i < tp.NumField(); i++ {
+		fld := tp.Field(i)
+		for _, part := range strings.Split(string(fld.Tag), " ") {
+			if part == revTag {
+				name, _ := jsonName(fld)
+				return name
+			}
+		}
+		if fld.Name == "Rev" {
+			byName = &fld
+		}
+	}
+	if byName != nil {
+		if name, skip := jsonName(*byName); !skip {
+			return name
+		}
+	}
+	return "Rev"
+}
+
+// revOf return the revision of val, false if val don't have an
+// integer revision field
+func revOf(r *reflector.R, val interface{}) (int64, bool) {
+	rev := reflect.ValueOf(r.GetFieldOrTag(val, "Rev", revTag, nil))
+	switch rev.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rev.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rev.Uint()), true
+	}
+	return 0, false
 }
 
-func (t *Table) docExists(id string) (bool, error) {
+func (t *Table) docExists(ctx context.Context, id string) (bool, error) {
 	var exists bool
-	err := t.owner.db.QueryRow(fmt.Sprintf("select true from %v where docid = $1", t.name), id).Scan(&exists)
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("select true from %v where docid = $1", t.name), id).Scan(&exists)
 	if err == sql.ErrNoRows {
 		err = nil
 		exists = false
 	}
 	return exists, err
 }
+
+// Delete remove the document with the given id, deleting a document
+// that doesn't exist isn't an error.
+//
+// Links registered with Database.CascadeLinks are also removed.
+func (t *Table) Delete(id string) error {
+	return t.DeleteContext(context.Background(), id)
+}
+
+func (t *Table) DeleteContext(ctx context.Context, id string) error {
+	_, err := t.delete(ctx, "docid = $1", []interface{}{id})
+	return referencedError(err, t.name, id)
+}
+
+// DeleteWhere remove all documents matched by the filters of the
+// given query and return how many documents were removed.
+//
+// Order, limit and offset are ignored.
+func (t *Table) DeleteWhere(q *Query) (int64, error) {
+	return t.DeleteWhereContext(context.Background(), q)
+}
+
+func (t *Table) DeleteWhereContext(ctx context.Context, q *Query) (int64, error) {
+	if q == nil || len(q.filter) == 0 {
+		return 0, errAtLeastOneParameter
+	}
+	if q.comparesTimestamps() {
+		if err := t.owner.installTimestamp(t.db); err != nil {
+			return 0, err
+		}
+	}
+	buf := &bytes.Buffer{}
+	params, err := q.writeFilter(buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	count, err := t.delete(ctx, string(buf.Bytes()), params)
+	return count, referencedError(err, t.name, "")
+}
+
+func (t *Table) delete(ctx context.Context, where string, params []interface{}) (int64, error) {
+	links := t.owner.cascadeFor(t.name)
+	if len(links) == 0 {
+		res, err := t.db.ExecContext(ctx, fmt.Sprintf("delete from %v where %v", t.name, where), params...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	// a single statement, so links and documents are removed
+	// atomically even without a transaction
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "with deleted as (delete from %v where %v returning docid)", t.name, where)
+	for i, l := range links {
+		fmt.Fprintf(buf, ", link%d as (delete from %v where _from in (select docid from deleted) or _to in (select docid from deleted))", i, l)
+	}
+	fmt.Fprintf(buf, " select count(*) from deleted")
+	var count int64
+	err := t.db.QueryRowContext(ctx, string(buf.Bytes()), params...).Scan(&count)
+	return count, err
+}
@@ -6,8 +6,7 @@ import (
 	"fmt"
 )
 
-func (t *tableDef) create(owner *Database) error {
-	db := owner.db
+func (t *tableDef) create(db querier) error {
 	buf := &bytes.Buffer{}
 	fmt.Fprintf(buf, "create table %v (", t.name)
 	for i, col := range t.def {
@@ -50,8 +49,7 @@ func (t *tableDef) create(owner *Database) error {
 	return err
 }
 
-func (t *tableDef) exists(owner *Database) (bool, error) {
-	db := owner.db
+func (t *tableDef) exists(db querier) (bool, error) {
 	var out bool
 	err := db.QueryRow("select true from pg_tables tbl where tbl.tablename = $1", t.name).Scan(&out)
 	if err == sql.ErrNoRows {
@@ -60,3 +58,60 @@ func (t *tableDef) exists(owner *Database) (bool, error) {
 	}
 	return out, err
 }
+
+// upgrade add the columns that are missing on tables created by
+// older versions of this package and widen varchar columns that
+// are shorter than expected
+func (t *tableDef) upgrade(db querier) error {
+	cols, err := t.columns(db)
+	if err != nil {
+		return err
+	}
+	for _, col := range t.def {
+		var cmd string
+		if info, has := cols[col.name]; !has {
+			cmd = fmt.Sprintf("alter table %v add column %v %v %v", t.name, col.name, col.kind, col.notnull)
+		} else if info.length > 0 && info.length < col.varcharLen() {
+			cmd = fmt.Sprintf("alter table %v alter column %v type %v", t.name, col.name, col.kind)
+		} else {
+			continue
+		}
+		if _, err := db.Exec(cmd); err != nil {
+			return err
+		}
+		if _, has := cols[col.name]; !has && len(col.idx) > 0 {
+			if _, err := db.Exec(fmt.Sprintf("create index idx_%v_%v on %v using %v(%v)", t.name, col.name, t.name, col.idx, col.name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// columns return the columns of the table
+func (t *tableDef) columns(db querier) (map[string]columnInfo, error) {
+	rows, err := db.Query("select column_name, data_type, character_maximum_length from information_schema.columns where table_name = $1", t.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]columnInfo)
+	for rows.Next() {
+		var name, kind string
+		var length sql.NullInt64
+		if err := rows.Scan(&name, &kind, &length); err != nil {
+			return nil, err
+		}
+		out[name] = columnInfo{kind, int(length.Int64)}
+	}
+	return out, rows.Err()
+}
+
+// varcharLen return the size of varchar columns or 0 for other types
+func (c *columnDef) varcharLen() int {
+	var n int
+	if _, err := fmt.Sscanf(c.kind, "varchar(%d)", &n); err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package pgdoc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+type (
+	Direction int
+
+	// Step is one link followed by Link.Traverse, the iterator
+	// returned by Traverse can scan into a Step.
+	Step struct {
+		// document reached by this step
+		Id     string
+		LinkId string
+		From   string
+		To     string
+		Label  string
+		// 1 for the links of the start document
+		Depth int
+		// documents visited from the start up to Id, including both
+		Path []string
+		// Id was already in the path, the traversal don't continue
+		// from this step
+		Cycle bool
+		// body of the link
+		Body json.RawMessage
+	}
+)
+
+const (
+	// Follow links from _from to _to
+	Outgoing = Direction(iota)
+	// Follow links from _to to _from
+	Incoming
+	// Follow links in both directions
+	Both
+)
+
+// Traverse follows the links starting at the document start, up to
+// maxDepth links away (zero means no limit). Only links whose label
+// is in labels are followed, an empty labels follows every link.
+//
+// Every link followed is returned as a Step, sorted by depth. Each
+// document is visited once per path, if a link goes back to a
+// document already in the path the step is marked as a Cycle and the
+// traversal stops there.
+func (l *Link) Traverse(start string, dir Direction, labels []string, maxDepth int) Iterator {
+	return l.TraverseContext(context.Background(), start, dir, labels, maxDepth)
+}
+
+func (l *Link) TraverseContext(ctx context.Context, start string, dir Direction, labels []string, maxDepth int) Iterator {
+	// match return the condition that selects the links of node and
+	// next the expression with the document on the other end
+	var match, next func(node string) string
+	switch dir {
+	case Outgoing:
+		match = func(node string) string { return fmt.Sprintf("l._from = %v", node) }
+		next = func(node string) string { return "l._to" }
+	case Incoming:
+		match = func(node string) string { return fmt.Sprintf("l._to = %v", node) }
+		next = func(node string) string { return "l._from" }
+	case Both:
+		match = func(node string) string { return fmt.Sprintf("(l._from = %v or l._to = %v)", node, node) }
+		next = func(node string) string {
+			return fmt.Sprintf("(case when l._from = %v then l._to else l._from end)", node)
+		}
+	default:
+		return errIter{fmt.Errorf("invalid direction %v", dir)}
+	}
+	params := []interface{}{start, maxDepth}
+	labelFilter := ""
+	if len(labels) > 0 {
+		params = append(params, pq.Array(labels))
+		labelFilter = " and l.label = any($3)"
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "with recursive walk(linkid, _from, _to, label, body, node, depth, path, cycle) as (")
+	fmt.Fprintf(buf, "select l.linkid, l._from, l._to, l.label, l.body, %v::text, 1, array[$1::text, %v::text], %v = $1 from %v l where %v%v",
+		next("$1"), next("$1"), next("$1"), l.name, match("$1"), labelFilter)
+	fmt.Fprintf(buf, " union all ")
+	fmt.Fprintf(buf, "select l.linkid, l._from, l._to, l.label, l.body, %v::text, w.depth + 1, w.path || %v::text, %v = any(w.path) from walk w join %v l on %v",
+		next("w.node"), next("w.node"), next("w.node"), l.name, match("w.node"))
+	fmt.Fprintf(buf, " where not w.cycle and ($2 <= 0 or w.depth < $2) and l.linkid <> w.linkid%v)", labelFilter)
+	fmt.Fprintf(buf, " select json_build_object(%v) from walk order by depth, linkid", strings.Join([]string{
+		"'Id', node", "'LinkId', linkid", "'From', _from", "'To', _to", "'Label', label",
+		"'Depth', depth", "'Path', path", "'Cycle', cycle", "'Body', body",
+	}, ", "))
+
+	rows, err := l.db.QueryContext(ctx, string(buf.Bytes()), params...)
+	if err != nil {
+		return errIter{err}
+	}
+	return newIterator(rows, l.owner)
+}
@@ -0,0 +1,227 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// ReapError has the errors found by Reap for each table, the
+	// other tables were reaped anyway
+	ReapError struct {
+		Errors map[string]error
+	}
+)
+
+var (
+	errNegativeTTL = errors.New("ttl can't be negative")
+)
+
+const (
+	ttlMeta    = "ttl"
+	expiresTag = `pgdoc:"ExpiresAt"`
+	// condition used to hide expired documents
+	notExpired = "(expires_at is null or expires_at > now())"
+	// how many documents are removed by each delete of the reaper
+	reapBatch = 1000
+)
+
+// expiresAt return when val should expire, the field tagged with
+// pgdoc:"ExpiresAt" has precedence over the TTL of the table.
+//
+// An invalid NullTime means that the document never expires.
+func (t *Table) expiresAt(val interface{}) pq.NullTime {
+	switch at := t.owner.reflector.GetFieldOrTag(val, "", expiresTag, nil).(type) {
+	case time.Time:
+		if !at.IsZero() {
+			return pq.NullTime{Time: at, Valid: true}
+		}
+	case *time.Time:
+		if at != nil && !at.IsZero() {
+			return pq.NullTime{Time: *at, Valid: true}
+		}
+	}
+	if t.ttl > 0 {
+		return pq.NullTime{Time: time.Now().Add(t.ttl), Valid: true}
+	}
+	return pq.NullTime{}
+}
+
+// expiration is like expiresAt but also registers the table for Reap
+// when val expires and the table has no TTL
+func (t *Table) expiration(ctx context.Context, val interface{}) (pq.NullTime, error) {
+	at := t.expiresAt(val)
+	if at.Valid && t.ttl == 0 {
+		return at, t.owner.markExpiring(ctx, t.db, t.name)
+	}
+	return at, nil
+}
+
+// markExpiring registers a TTL of zero for table, Reap only removes
+// the documents of tables with a TTL. The registration is remembered
+// once it is committed.
+func (d *Database) markExpiring(ctx context.Context, db querier, table string) error {
+	d.mu.RLock()
+	marked := d.expiring[table]
+	d.mu.RUnlock()
+	if marked {
+		return nil
+	}
+	if err := d.ensureMeta(db); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "insert into "+metaTable+" (tblname, kind, body) values ($1, $2, $3) on conflict (tblname, kind) do nothing",
+		table, ttlMeta, jsonCol{time.Duration(0), nil}.plain())
+	if err != nil {
+		return err
+	}
+	if _, inTx := db.(*sql.Tx); !inTx {
+		d.mu.Lock()
+		if d.expiring == nil {
+			d.expiring = make(map[string]bool)
+		}
+		d.expiring[table] = true
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// SetTTL changes the TTL of the table, documents saved after it expire
+// ttl after being saved. Zero removes the TTL and the expiration of
+// every document, including the ones set by pgdoc:"ExpiresAt".
+//
+// Other handles of the table keep the previous TTL until the table is
+// opened again.
+func (t *Table) SetTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return errNegativeTTL
+	}
+	err := t.owner.inTransaction(context.Background(), t.db, func(tx *sql.Tx) error {
+		if ttl > 0 {
+			return t.owner.setMetaOn(tx, t.name, ttlMeta, ttl)
+		}
+		if err := t.owner.ensureMeta(tx); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("delete from "+metaTable+" where tblname = $1 and kind = $2", t.name, ttlMeta); err != nil {
+			return err
+		}
+		_, err := tx.Exec(fmt.Sprintf("update %v set expires_at = null where expires_at is not null", t.name))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.ttl = ttl
+	t.owner.mu.Lock()
+	delete(t.owner.expiring, t.name)
+	t.owner.mu.Unlock()
+	return nil
+}
+
+// loadTTL register opts.TTL as the TTL of the table, or load the TTL
+// registered by someone else if opts.TTL is zero.
+func (d *Database) loadTTL(db querier, table string, opts TableOptions) (time.Duration, error) {
+	if opts.TTL > 0 {
+		return opts.TTL, d.setMetaOn(db, table, ttlMeta, opts.TTL)
+	}
+	var ttl time.Duration
+	_, err := d.getMetaOn(context.Background(), db, table, ttlMeta, &ttl)
+	return ttl, err
+}
+
+func (e *ReapError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%v: %v", name, e.Errors[name])
+	}
+	return "reap failed on " + strings.Join(msgs, "; ")
+}
+
+// Reap deletes every expired document of the tables with a TTL (see
+// TableOptions.TTL) or documents tagged with pgdoc:"ExpiresAt", links
+// registered with CascadeLinks are removed too. Returns how many
+// documents were deleted.
+//
+// Documents are deleted in batches, so a large number of expired
+// documents don't hold locks for a long time. If a table fails the
+// others are still reaped and a ReapError is returned.
+func (d *Database) Reap(ctx context.Context) (int64, error) {
+	if err := d.ensureMeta(d.db); err != nil {
+		return 0, err
+	}
+	// the meta of dropped tables is kept
+	rows, err := d.db.QueryContext(ctx, `select m.tblname from `+metaTable+` m
+		join information_schema.tables t on t.table_name = m.tblname and t.table_schema = current_schema()
+		where m.kind = $1 order by 1`, ttlMeta)
+	if err != nil {
+		return 0, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	failed := &ReapError{Errors: make(map[string]error)}
+	for _, name := range tables {
+		t := &Table{name: name, owner: d, db: d.db}
+		where := fmt.Sprintf("docid in (select docid from %v where expires_at <= now() limit %d)", name, reapBatch)
+		for {
+			n, err := t.delete(ctx, where, nil)
+			total += n
+			if err != nil {
+				failed.Errors[name] = err
+				break
+			}
+			if n < reapBatch {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+	}
+	if len(failed.Errors) > 0 {
+		return total, failed
+	}
+	return total, nil
+}
+
+// StartReaper calls Reap every interval until ctx is done. Errors are
+// ignored, expired documents are hidden anyway and the next call
+// will try to remove them again.
+func (d *Database) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.Reap(ctx)
+			}
+		}
+	}()
+}
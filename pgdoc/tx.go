@@ -0,0 +1,123 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type (
+	// Tx groups operations over many tables and links, nothing is
+	// visible to other sessions until Commit is called.
+	//
+	// Tables and Links obtained from a Tx MUST NOT be used after
+	// Commit or Rollback.
+	Tx struct {
+		tx    *sql.Tx
+		owner *Database
+	}
+)
+
+// Begin starts a new transaction
+func (d *Database) Begin() (*Tx, error) {
+	return d.BeginContext(context.Background())
+}
+
+// BeginContext starts a new transaction, the transaction is rolled
+// back if ctx is done before Commit is called
+func (d *Database) BeginContext(ctx context.Context) (*Tx, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx, d}, nil
+}
+
+// Transaction execute op inside a new transaction, if op returns an
+// error or panics the transaction is rolled back, otherwise it is
+// committed.
+func (d *Database) Transaction(op func(tx *Tx) error) error {
+	return d.TransactionContext(context.Background(), op)
+}
+
+func (d *Database) TransactionContext(ctx context.Context, op func(tx *Tx) error) error {
+	tx, err := d.BeginContext(ctx)
+	if err != nil {
+		return err
+	}
+	return doInsideTransaction(tx.tx, func(_ *sql.Tx) error {
+		return op(tx)
+	})
+}
+
+// Table is like Database.Table but every operation is executed
+// inside this transaction
+func (t *Tx) Table(name string) (*Table, error) {
+	return t.owner.table(t.tx, name, TableOptions{})
+}
+
+// Link is like Database.Link but every operation is executed
+// inside this transaction
+func (t *Tx) Link(name string) (*Link, error) {
+	return t.owner.link(t.tx, name, TableOptions{})
+}
+
+func (t *Tx) TableWithOptions(name string, opts TableOptions) (*Table, error) {
+	return t.owner.table(t.tx, name, opts)
+}
+
+func (t *Tx) LinkWithOptions(name string, opts TableOptions) (*Link, error) {
+	return t.owner.link(t.tx, name, opts)
+}
+
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// inTransaction execute op using db when it is already a transaction,
+// otherwise a new transaction is used just for op
+func (d *Database) inTransaction(ctx context.Context, db querier, op func(tx *sql.Tx) error) error {
+	if tx, ok := db.(*sql.Tx); ok {
+		return op(tx)
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return doInsideTransaction(tx, op)
+}
+
+func doInsideTransaction(tx *sql.Tx, op func(tx *sql.Tx) error) (err error) {
+	defer func() {
+		if problem := recover(); problem != nil {
+			// a panic, should abort this
+			err = tx.Rollback()
+			if err != nil {
+				err = fmt.Errorf("%v happened when rollingback a transaction. cause [panic]: %v", err, problem)
+			} else {
+				err = fmt.Errorf("rollback [panic]: %v", problem)
+			}
+			return
+		}
+
+		// no panic, let's check the error
+		if err == nil {
+			// everything is fine, let's commit
+			err = tx.Commit()
+		} else {
+			// oops, need to rollback
+			tmp := tx.Rollback()
+			if tmp != nil {
+				err = fmt.Errorf("%v happened when rollingback a transaction. cause [error]: %v", tmp, err)
+			}
+			// if we didn't got an error from rollback, just let the initial
+			// error go to the outside
+		}
+	}()
+	err = op(tx)
+	return
+}
@@ -0,0 +1,202 @@
+package pgdoc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+type (
+	EventOp string
+
+	// Event describes a change made to a document or link
+	Event struct {
+		Op EventOp
+		// docid or linkid of the changed row
+		Id string
+		// Current body of the row, only filled when requested and
+		// Op is Inserted or Updated.
+		//
+		// The body is read after the event is received, so it might
+		// be newer than the change that caused the event.
+		Body json.RawMessage
+		// only for Failed
+		Err error
+	}
+
+	notifyPayload struct {
+		Op string `json:"op"`
+		Id string `json:"id"`
+	}
+)
+
+const (
+	Inserted = EventOp("INSERT")
+	Updated  = EventOp("UPDATE")
+	Deleted  = EventOp("DELETE")
+	// Resync is sent after the connection used to listen for changes
+	// was lost and reestablished, events might have been lost while
+	// the connection was down.
+	Resync = EventOp("RESYNC")
+	// Failed is sent when the connection used to listen for changes
+	// fails, Err has the cause. The connection is reestablished
+	// and Resync is sent when it succeeds.
+	Failed = EventOp("ERROR")
+)
+
+var (
+	errNoDSN = errors.New("database opened without a connection string, cannot watch for changes")
+)
+
+const (
+	notifyFunction = `create or replace function pgdoc_notify() returns trigger as $$
+declare
+	rec record;
+begin
+	if TG_OP = 'DELETE' then
+		rec := OLD;
+	else
+		rec := NEW;
+	end if;
+	perform pg_notify(TG_ARGV[0], json_build_object('op', TG_OP, 'id', row_to_json(rec)->>TG_ARGV[1])::text);
+	return null;
+end;
+$$ language plpgsql`
+)
+
+// Watch send an Event over the returned channel every time a document
+// of this table is inserted, updated or deleted. The channel is closed
+// when ctx is done.
+//
+// If withBody is true, the current body of inserted or updated
+// documents is sent with the event. Errors of the connection are
+// sent as Failed events.
+func (t *Table) Watch(ctx context.Context, withBody bool) (<-chan Event, error) {
+	return t.owner.watch(ctx, t.name, "docid", withBody)
+}
+
+// Watch is like Table.Watch but for links
+func (l *Link) Watch(ctx context.Context, withBody bool) (<-chan Event, error) {
+	return l.owner.watch(ctx, l.name, "linkid", withBody)
+}
+
+func notifyChannel(table string) string {
+	return "pgdoc_" + table
+}
+
+func (d *Database) watch(ctx context.Context, table, idcol string, withBody bool) (<-chan Event, error) {
+	if len(d.dsn) == 0 {
+		return nil, errNoDSN
+	}
+	if err := d.installNotify(table, idcol); err != nil {
+		return nil, err
+	}
+
+	// the callback runs in the goroutine of the listener, so the
+	// errors are dropped while the previous one wasn't read
+	failures := make(chan error, 1)
+	listener := pq.NewListener(d.dsn, 10*time.Millisecond, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err == nil {
+			return
+		}
+		select {
+		case failures <- err:
+		default:
+		}
+	})
+	if err := listener.Listen(notifyChannel(table)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer listener.Close()
+		ping := time.NewTicker(time.Minute)
+		defer ping.Stop()
+		for {
+			var ev Event
+			select {
+			case <-ctx.Done():
+				return
+			case <-ping.C:
+				// check if the connection is still alive, if it isn't
+				// the listener reconnects on its own and sends a nil
+				// notification, so the error isn't needed here
+				_ = listener.Ping()
+				continue
+			case err := <-failures:
+				ev.Op, ev.Err = Failed, err
+			case n := <-listener.Notify:
+				if n == nil {
+					// pq sends nil after a reconnection
+					ev.Op = Resync
+				} else {
+					var p notifyPayload
+					if err := json.Unmarshal([]byte(n.Extra), &p); err != nil {
+						continue
+					}
+					ev.Op, ev.Id = EventOp(p.Op), p.Id
+					if withBody && ev.Op != Deleted {
+						ev.Body = d.rawBody(ctx, table, idcol, ev.Id)
+					}
+				}
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// installNotify creates the trigger that notify changes on the table,
+// it is safe to call it many times, even from many processes at the
+// same time.
+func (d *Database) installNotify(table, idcol string) error {
+	trigger := "trg_" + table + "_notify"
+	if exists, err := triggerExists(d.db, trigger); err != nil || exists {
+		return err
+	}
+	return d.inTransaction(context.Background(), d.db, func(tx *sql.Tx) error {
+		// concurrent calls would fail replacing the same function
+		if _, err := tx.Exec("select pg_advisory_xact_lock(hashtext('pgdoc_notify'))"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(notifyFunction); err != nil {
+			return err
+		}
+		// replaces the trigger created since the check above
+		if _, err := tx.Exec(fmt.Sprintf("drop trigger if exists %v on %v", trigger, table)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(fmt.Sprintf("create trigger %v after insert or update or delete on %v for each row execute procedure pgdoc_notify(%v, %v)",
+			trigger, table, pq.QuoteLiteral(notifyChannel(table)), pq.QuoteLiteral(idcol)))
+		return err
+	})
+}
+
+func triggerExists(db querier, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("select true from pg_trigger where tgname = $1", name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return exists, err
+}
+
+func (d *Database) rawBody(ctx context.Context, table, idcol, id string) json.RawMessage {
+	var body []byte
+	err := d.db.QueryRowContext(ctx, fmt.Sprintf("select body from %v where %v = $1", table, idcol), id).Scan(&body)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(body)
+}